@@ -0,0 +1,200 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/valyala/fasthttp"
+)
+
+// HTTPAuto picks the protocol per origin: TLS connections negotiate h2 or
+// http/1.1 via ALPN, and origins that advertise h3 through Alt-Svc are
+// upgraded to HTTP/3 until the advertisement expires or QUIC fails.
+
+const (
+	defaultAltSvcMaxAge = 24 * time.Hour
+	altSvcBrokenFor     = 5 * time.Minute
+)
+
+type altSvcEntry struct {
+	addr        string
+	expires     time.Time
+	brokenUntil time.Time
+}
+
+type altSvcCache struct {
+	dial quicDialFunc
+
+	mu      sync.Mutex
+	entries map[string]*altSvcEntry
+}
+
+// lookup returns the address to dial HTTP/3 on for origin, if any.
+func (a *altSvcCache) lookup(origin string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := a.entries[origin]
+	if e == nil || e.addr == "" {
+		return "", false
+	}
+	now := time.Now()
+	if now.After(e.expires) || now.Before(e.brokenUntil) {
+		return "", false
+	}
+	return e.addr, true
+}
+
+// update records the Alt-Svc header value received from origin.
+func (a *altSvcCache) update(origin string, header []byte) {
+	if len(header) == 0 {
+		return
+	}
+	addr, maxAge, clear := parseAltSvc(string(header), origin)
+	if !clear && addr == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := a.entries[origin]
+	if clear {
+		if e != nil {
+			e.addr = ""
+		}
+		return
+	}
+	if e == nil {
+		if a.entries == nil {
+			a.entries = make(map[string]*altSvcEntry)
+		}
+		e = &altSvcEntry{}
+		a.entries[origin] = e
+	}
+	e.addr = addr
+	e.expires = time.Now().Add(maxAge)
+}
+
+// markBroken stops using HTTP/3 for origin for a while after QUIC failed.
+func (a *altSvcCache) markBroken(origin string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e := a.entries[origin]; e != nil {
+		e.brokenUntil = time.Now().Add(altSvcBrokenFor)
+	}
+}
+
+// parseAltSvc returns the first h3 alternative of an Alt-Svc header value
+// (RFC 7838) as an address to dial, or clear if the origin withdrew them.
+func parseAltSvc(header, origin string) (addr string, maxAge time.Duration, clear bool) {
+	if strings.TrimSpace(header) == "clear" {
+		return "", 0, true
+	}
+	originHost, _, err := net.SplitHostPort(origin)
+	if err != nil {
+		originHost = origin
+	}
+	for _, alt := range strings.Split(header, ",") {
+		params := strings.Split(alt, ";")
+		proto, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || proto != "h3" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil {
+			continue
+		}
+		if host == "" {
+			host = originHost
+		}
+		maxAge = defaultAltSvcMaxAge
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k == "ma" {
+				if secs, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil {
+					maxAge = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		return net.JoinHostPort(host, port), maxAge, false
+	}
+	return "", 0, false
+}
+
+// dialAltSvc is the http3.Transport dialer in HTTPAuto mode: it dials the
+// advertised alternative while keeping the origin as the TLS server name.
+func (a *altSvcCache) dialAltSvc(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	if alt, ok := a.lookup(addr); ok {
+		addr = alt
+	}
+	return a.dial(ctx, addr, tlsCfg, cfg)
+}
+
+func (c *Client) doAuto(ctx context.Context, req *Request, resp *Response) error {
+	var origin string
+	uri := req.URI()
+	if string(uri.Scheme()) == "https" && c.connectsDirectly() {
+		origin = fasthttp.AddMissingPort(string(uri.Host()), true)
+	}
+	if _, ok := c.altSvc.lookup(origin); ok && origin != "" {
+		h3ctx, sent := trackHeadersSent(ctx)
+		err := c.doNetHTTP(h3ctx, req, resp)
+		if err == nil {
+			c.altSvc.update(origin, resp.Header.Peek(fasthttp.HeaderAltSvc))
+			return nil
+		}
+		if ctx.Err() == nil && isQUICError(err) {
+			c.altSvc.markBroken(origin)
+		}
+		if !h3Replayable(ctx, req, err, sent.Load()) {
+			return err
+		}
+	}
+	if err := c.doNativeHTTP2(ctx, req, resp); err != nil {
+		return err
+	}
+	if origin != "" {
+		c.altSvc.update(origin, resp.Header.Peek(fasthttp.HeaderAltSvc))
+	}
+	return nil
+}
+
+// trackHeadersSent returns a context that sets sent once the headers of the
+// net/http request made with it have been written.
+func trackHeadersSent(ctx context.Context) (context.Context, *atomic.Bool) {
+	sent := new(atomic.Bool)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteHeaders: func() { sent.Store(true) },
+	}), sent
+}
+
+// h3Replayable reports whether a request that failed over HTTP/3 with err
+// may be sent again over HTTP/2. Once its headers are sent the server may
+// have processed it, so only idempotent requests are then.
+func h3Replayable(ctx context.Context, req *Request, err error, sent bool) bool {
+	if ctx.Err() != nil || !isQUICError(err) || req.IsBodyStream() {
+		return false
+	}
+	return !sent || isIdempotent(string(req.Header.Method()))
+}
+
+func isQUICError(err error) bool {
+	var (
+		handshakeErr *quic.HandshakeTimeoutError
+		idleErr      *quic.IdleTimeoutError
+		transportErr *quic.TransportError
+		versionErr   *quic.VersionNegotiationError
+		resetErr     *quic.StatelessResetError
+		netErr       *net.OpError
+	)
+	return errors.As(err, &handshakeErr) || errors.As(err, &idleErr) ||
+		errors.As(err, &transportErr) || errors.As(err, &versionErr) ||
+		errors.As(err, &resetErr) || errors.As(err, &netErr)
+}
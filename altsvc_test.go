@@ -0,0 +1,225 @@
+package v2fasthttp
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestParseAltSvc(t *testing.T) {
+	cases := []struct {
+		header string
+		addr   string
+		maxAge time.Duration
+		clear  bool
+	}{
+		{`h3=":443"`, "example.com:443", defaultAltSvcMaxAge, false},
+		{`h3=":8443"; ma=60`, "example.com:8443", time.Minute, false},
+		{`h3-29=":443", h3="alt.example.com:443"; ma=10; persist=1`, "alt.example.com:443", 10 * time.Second, false},
+		{`h2=":443"`, "", 0, false},
+		{`clear`, "", 0, true},
+		{`h3=garbage`, "", 0, false},
+	}
+	for _, tc := range cases {
+		addr, maxAge, clear := parseAltSvc(tc.header, "example.com:443")
+		if addr != tc.addr || maxAge != tc.maxAge || clear != tc.clear {
+			t.Errorf("parseAltSvc(%q) = %q, %v, %v; want %q, %v, %v",
+				tc.header, addr, maxAge, clear, tc.addr, tc.maxAge, tc.clear)
+		}
+	}
+}
+
+func TestAltSvcCacheExpiryAndClear(t *testing.T) {
+	var a altSvcCache
+	a.update("example.com:443", []byte(`h3=":443"; ma=60`))
+	if addr, ok := a.lookup("example.com:443"); !ok || addr != "example.com:443" {
+		t.Fatalf("lookup = %q, %v", addr, ok)
+	}
+
+	a.entries["example.com:443"].expires = time.Now().Add(-time.Second)
+	if _, ok := a.lookup("example.com:443"); ok {
+		t.Fatalf("expected expired entry to be ignored")
+	}
+
+	a.update("example.com:443", []byte(`h3=":443"`))
+	a.update("example.com:443", []byte(`clear`))
+	if _, ok := a.lookup("example.com:443"); ok {
+		t.Fatalf("expected clear to drop the alternative")
+	}
+
+	a.update("example.com:443", []byte(`h3=":443"`))
+	a.markBroken("example.com:443")
+	if _, ok := a.lookup("example.com:443"); ok {
+		t.Fatalf("expected broken alternative to be ignored")
+	}
+}
+
+// newTestAltSvcServer starts an h2 server whose responses advertise altPort
+// as an h3 alternative.
+func newTestAltSvcServer(t *testing.T, altPort string) string {
+	t.Helper()
+	h := protoEchoHandler()
+	srv := newTestH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+altPort+`"; ma=60`)
+		h.ServeHTTP(w, r)
+	}))
+	return srv.URL
+}
+
+func TestHTTPAutoUpgradesToHTTP3(t *testing.T) {
+	h3URL := newTestH3Server(t, protoEchoHandler())
+	_, h3Port, _ := net.SplitHostPort(h3URL[len("https://"):])
+	base := newTestAltSvcServer(t, h3Port)
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTPAuto,
+		TLSConfig:   testClientTLSConfig(),
+	})
+	defer c.CloseIdleConnections()
+
+	for _, want := range []string{"HTTP/2.0", "HTTP/3.0", "HTTP/3.0"} {
+		body, _, err := c.GetBytes(base)
+		if err != nil {
+			t.Fatalf("GetBytes: %v", err)
+		}
+		if string(body) != want {
+			t.Fatalf("body = %q, want %q", body, want)
+		}
+	}
+}
+
+func TestHTTPAutoFallsBackWhenQUICFails(t *testing.T) {
+	// A UDP socket that never answers.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer pc.Close()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	base := newTestAltSvcServer(t, port)
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTPAuto,
+		TLSConfig:   testClientTLSConfig(),
+	})
+	defer c.CloseIdleConnections()
+	c.httpClient.Transport.(*http3.Transport).QUICConfig = &quic.Config{
+		HandshakeIdleTimeout: 200 * time.Millisecond,
+	}
+
+	// A POST that never got out over QUIC is sent over HTTP/2.
+	for i := 0; i < 3; i++ {
+		body, _, err := c.PostBytes(base, []byte("a=1"))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if !strings.HasPrefix(string(body), "HTTP/2.0") {
+			t.Fatalf("request %d: body = %q, want HTTP/2.0", i, body)
+		}
+	}
+	if _, ok := c.altSvc.lookup(base[len("https://"):]); ok {
+		t.Fatalf("expected the h3 alternative to be marked broken")
+	}
+}
+
+// newTestVanishingH3Server starts an HTTP/3 server whose socket is closed
+// as soon as it gets a POST, which then fails with a QUIC error after being
+// sent. It returns the number of POSTs it got.
+func newTestVanishingH3Server(t *testing.T, pc net.PacketConn) *atomic.Int32 {
+	t.Helper()
+	posts := new(atomic.Int32)
+	h := protoEchoHandler()
+	srv := &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				posts.Add(1)
+				_ = pc.Close()
+				return
+			}
+			h.ServeHTTP(w, r)
+		}),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{testCertificate(t)},
+		}),
+	}
+	go func() { _ = srv.Serve(pc) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = pc.Close()
+	})
+	return posts
+}
+
+// countPOSTs wraps h, counting the POST requests it gets.
+func countPOSTs(h http.Handler, posts *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posts.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestHTTPAutoDoesNotReplaySentPOST(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	h3Posts := newTestVanishingH3Server(t, pc)
+	_, h3Port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	var h2Posts atomic.Int32
+	srv := newTestH2Server(t, countPOSTs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+h3Port+`"; ma=60`)
+		protoEchoHandler().ServeHTTP(w, r)
+	}), &h2Posts))
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion:  HTTPAuto,
+		TLSConfig:    testClientTLSConfig(),
+		HTTP3Options: HTTP3Options{MaxIdleTimeout: 300 * time.Millisecond},
+	})
+	defer c.CloseIdleConnections()
+	for _, want := range []string{"HTTP/2.0", "HTTP/3.0"} {
+		if body, _, err := c.GetBytes(srv.URL); err != nil || string(body) != want {
+			t.Fatalf("GetBytes: %q, %v; want %s", body, err, want)
+		}
+	}
+
+	if _, _, err := c.PostBytes(srv.URL, []byte("a=1")); err == nil {
+		t.Fatalf("expected the POST to fail")
+	}
+	if h3Posts.Load() != 1 || h2Posts.Load() != 0 {
+		t.Fatalf("POST sent %d times over HTTP/3 and %d over HTTP/2", h3Posts.Load(), h2Posts.Load())
+	}
+}
+
+func TestHTTPAutoNegotiatesHTTP1(t *testing.T) {
+	tlsSrv := httptest.NewTLSServer(protoEchoHandler())
+	defer tlsSrv.Close()
+	plainSrv := httptest.NewServer(protoEchoHandler())
+	defer plainSrv.Close()
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTPAuto,
+		TLSConfig:   testClientTLSConfig(),
+	})
+	defer c.CloseIdleConnections()
+
+	for _, url := range []string{tlsSrv.URL, plainSrv.URL} {
+		body, _, err := c.GetBytes(url)
+		if err != nil {
+			t.Fatalf("GetBytes(%s): %v", url, err)
+		}
+		if string(body) != "HTTP/1.1" {
+			t.Fatalf("GetBytes(%s): body = %q, want HTTP/1.1", url, body)
+		}
+	}
+}
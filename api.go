@@ -6,19 +6,20 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/valyala/fasthttp"
-	"github.com/valyala/fasthttp/fasthttpproxy"
 	"golang.org/x/net/http2"
-	xnetproxy "golang.org/x/net/proxy"
 )
 
 type (
@@ -28,6 +29,25 @@ type (
 		fasthttp.Client
 		httpVersion HTTPVersion
 		httpClient  *http.Client
+		h1Conns     h1ConnPool
+		altSvc      *altSvcCache
+		h3Downgrade atomic.Pointer[h3DowngradeState]
+		// transports are swapped by the proxy setters under transportsMu.
+		transports   atomic.Pointer[clientTransports]
+		transportsMu sync.Mutex
+		// proxyClients serve the requests that have a proxy of their own.
+		proxyClients proxyClients
+		// fasthttpDial is set once Client.Dial is dialFasthttp. A Client
+		// built without NewClientWithOptions gets it on its first proxy
+		// change, which must then happen before its first request.
+		fasthttpDial atomic.Bool
+
+		// h3Race and h3RaceDelay bring racing back when the proxy is cleared.
+		h3Race      bool
+		h3RaceDelay time.Duration
+
+		quicTransport *quic.Transport
+		h3ZeroRTT     bool
 	}
 	Request        = fasthttp.Request
 	Response       = fasthttp.Response
@@ -39,6 +59,7 @@ const (
 	HTTP1 HTTPVersion = iota + 1
 	HTTP2
 	HTTP3
+	HTTPAuto
 )
 
 var defaultClient = &Client{
@@ -65,114 +86,549 @@ func Post(dst []byte, url string, postArgs *fasthttp.Args) (statusCode int, body
 	return defaultClient.Post(dst, url, postArgs)
 }
 
+func DoCtx(ctx context.Context, req *Request, resp *Response) error {
+	return defaultClient.DoCtx(ctx, req, resp)
+}
+
+func DoDeadline(req *Request, resp *Response, deadline time.Time) error {
+	return defaultClient.DoDeadline(req, resp, deadline)
+}
+
+func DoRedirects(req *Request, resp *Response, maxRedirectsCount int) error {
+	return defaultClient.DoRedirects(req, resp, maxRedirectsCount)
+}
+
+func GetDeadline(dst []byte, url string, deadline time.Time) (statusCode int, body []byte, err error) {
+	return defaultClient.GetDeadline(dst, url, deadline)
+}
+
 func (c *Client) useNetHTTP() bool {
-	return c != nil && (c.httpVersion == HTTP2 || c.httpVersion == HTTP3) && c.httpClient != nil
+	return c != nil && c.httpVersion != HTTP1 && c.httpClient != nil
+}
+
+// skipFasthttp reports whether requests bypass fasthttp's client: HTTP/2
+// and HTTP/3 clients have transports of their own, and a PAC script routes
+// each request.
+func (c *Client) skipFasthttp() bool {
+	return c.useNetHTTP() || c != nil && c.current().pac != nil
 }
 
 func (c *Client) Do(req *Request, resp *Response) error {
-	if !c.useNetHTTP() {
+	if !c.skipFasthttp() {
 		return c.Client.Do(req, resp)
 	}
-	httpReq, err := convertRequestToHTTP(req)
-	if err != nil {
-		return err
+	return c.roundTrip(context.Background(), req, resp)
+}
+
+func (c *Client) DoTimeout(req *Request, resp *Response, timeout time.Duration) error {
+	if !c.skipFasthttp() {
+		return c.Client.DoTimeout(req, resp, timeout)
 	}
-	httpResp, err := c.httpClient.Do(httpReq)
-	if err != nil {
+	return c.DoDeadline(req, resp, time.Now().Add(timeout))
+}
+
+// DoCtx performs the request and aborts it as soon as ctx is done, whatever
+// the HTTP version. Errors caused by ctx wrap ctx.Err().
+func (c *Client) DoCtx(ctx context.Context, req *Request, resp *Response) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	return convertHTTPResponse(httpResp, resp)
+	if p := requestProxyFromContext(ctx); p != nil {
+		if err := checkRequestProxy(p); err != nil {
+			return err
+		}
+		c.useRequestProxy(proxyPoolKey(p))
+	}
+	if !c.skipFasthttp() {
+		// fasthttp doesn't expose the connection, so RequestInfo needs the
+		// context-bound path.
+		if ctx.Done() == nil && requestInfoFromContext(ctx) == nil && requestProxyFromContext(ctx) == nil {
+			return c.Client.Do(req, resp)
+		}
+		return c.doCtxHTTP1(ctx, req, resp)
+	}
+	return ctxError(ctx, c.roundTrip(ctx, req, resp))
 }
 
-func (c *Client) DoTimeout(req *Request, resp *Response, timeout time.Duration) error {
-	if !c.useNetHTTP() {
-		return c.Client.DoTimeout(req, resp, timeout)
+func (c *Client) DoDeadline(req *Request, resp *Response, deadline time.Time) error {
+	if !c.skipFasthttp() {
+		return c.Client.DoDeadline(req, resp, deadline)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	// ctx also bounds reading a streamed body, so the body stream cancels
+	// it once read to the end or closed.
+	err := timeoutError(c.roundTrip(context.WithValue(ctx, streamCancelKey{}, cancel), req, resp))
+	if err == nil && resp.IsBodyStream() {
+		return nil
+	}
+	cancel()
+	return err
+}
+
+func (c *Client) DoRedirects(req *Request, resp *Response, maxRedirectsCount int) error {
+	if !c.skipFasthttp() {
+		return c.Client.DoRedirects(req, resp, maxRedirectsCount)
+	}
+	_, err := doRequestFollowRedirects(req, resp, req.URI().String(), maxRedirectsCount, c.Do)
+	return err
+}
+
+func (c *Client) Get(dst []byte, url string) (statusCode int, body []byte, err error) {
+	if !c.skipFasthttp() {
+		return c.Client.Get(dst, url)
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	return c.doFollowRedirectsBuffer(context.Background(), req, dst, url)
+}
+
+func (c *Client) GetTimeout(dst []byte, url string, timeout time.Duration) (statusCode int, body []byte, err error) {
+	if !c.skipFasthttp() {
+		return c.Client.GetTimeout(dst, url, timeout)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return c.GetDeadline(dst, url, time.Now().Add(timeout))
+}
+
+func (c *Client) GetDeadline(dst []byte, url string, deadline time.Time) (statusCode int, body []byte, err error) {
+	if !c.skipFasthttp() {
+		return c.Client.GetDeadline(dst, url, deadline)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
 
-	httpReq, err := convertRequestToHTTP(req)
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	statusCode, body, err = c.doFollowRedirectsBuffer(ctx, req, dst, url)
+	if err != nil {
+		return statusCode, dst, timeoutError(err)
+	}
+	return statusCode, body, nil
+}
+
+func (c *Client) Post(dst []byte, url string, postArgs *fasthttp.Args) (statusCode int, body []byte, err error) {
+	if !c.skipFasthttp() {
+		return c.Client.Post(dst, url, postArgs)
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/x-www-form-urlencoded")
+	if postArgs != nil {
+		if _, err := postArgs.WriteTo(req.BodyWriter()); err != nil {
+			return 0, nil, err
+		}
+	}
+	return c.doFollowRedirectsBuffer(context.Background(), req, dst, url)
+}
+
+func (c *Client) CloseIdleConnections() {
+	c.Client.CloseIdleConnections()
+	c.h1Conns.closeIdle("")
+	t := c.current()
+	if t.race != nil {
+		t.race.closeIdleConnections()
+	}
+	if t.h2 != nil {
+		t.h2.closeIdleConnections()
+	}
+	if c.httpClient != nil {
+		c.httpClient.CloseIdleConnections()
+	}
+	c.proxyClients.closeIdleConnections()
+}
+
+// roundTrip sends a request that bypasses fasthttp's client: through the
+// native HTTP/2 transport or net/http, or over the context-bound HTTP/1.1
+// path for HTTP1 clients with a PAC script.
+func (c *Client) roundTrip(ctx context.Context, req *Request, resp *Response) error {
+	t := c.current()
+	p := requestProxyFromContext(ctx)
+	switch {
+	case t.pac != nil && p == nil:
+		return c.doPAC(ctx, t.pac, req, resp)
+	case !c.useNetHTTP():
+		return c.doCtxHTTP1(ctx, req, resp)
+	case p != nil && (c.httpVersion == HTTP3 || c.httpVersion == HTTPAuto):
+		return c.roundTripProxied(ctx, p, req, resp)
+	}
+	if t.race != nil {
+		return t.race.roundTrip(ctx, req, resp)
+	}
+	if c.altSvc != nil {
+		return c.doAuto(ctx, req, resp)
+	}
+	if c.httpVersion == HTTP3 {
+		return c.doHTTP3(ctx, req, resp)
+	}
+	if t.h2 == nil {
+		return c.doNetHTTP(ctx, req, resp)
+	}
+	return c.doNativeHTTP2(ctx, req, resp)
+}
+
+type h3DowngradeState struct {
+	err error
+}
+
+// HTTP3Downgrade reports why HTTP/3 requests are sent over HTTP/2 instead
+// (the configured proxy can't carry UDP), or nil if they aren't.
+func (c *Client) HTTP3Downgrade() error {
+	if s := c.h3Downgrade.Load(); s != nil {
+		return s.err
+	}
+	return nil
+}
+
+func (c *Client) doHTTP3(ctx context.Context, req *Request, resp *Response) error {
+	if c.current().h2 == nil {
+		return c.doNetHTTP(ctx, req, resp)
+	}
+	if c.HTTP3Downgrade() == nil {
+		err := c.doNetHTTP(ctx, req, resp)
+		if !errors.Is(err, ErrProxyUDPUnsupported) || req.IsBodyStream() {
+			return err
+		}
+		c.h3Downgrade.CompareAndSwap(nil, &h3DowngradeState{err: err})
+	}
+	if info := requestInfoFromContext(ctx); info != nil {
+		info.Downgraded = true
+	}
+	return c.doNativeHTTP2(ctx, req, resp)
+}
+
+// requestTimeout is the total timeout the net/http clients apply.
+func (c *Client) requestTimeout() time.Duration {
+	if c.WriteTimeout > c.ReadTimeout {
+		return c.WriteTimeout
+	}
+	return c.ReadTimeout
+}
+
+func (c *Client) doNativeHTTP2(ctx context.Context, req *Request, resp *Response) error {
+	if timeout := c.requestTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return c.requestH2().roundTrip(ctx, req, resp)
+}
+
+func (c *Client) doNetHTTP(ctx context.Context, req *Request, resp *Response) error {
+	httpReq, err := convertRequestToHTTP(req, c.DisableHeaderNamesNormalizing)
 	if err != nil {
 		return err
 	}
 	httpReq = httpReq.WithContext(ctx)
+	if c.h3ZeroRTT {
+		use0RTT(httpReq)
+	}
 
-	httpResp, err := c.httpClient.Do(httpReq)
+	httpResp, err := c.requestHTTPClient(ctx).Do(httpReq)
 	if err != nil {
 		return err
 	}
-	return convertHTTPResponse(httpResp, resp)
+	stream := resp.StreamBody || c.StreamResponseBody
+	if stream {
+		httpResp.Body = deadlineBody(ctx, httpResp.Body)
+	}
+	if err := convertHTTPResponse(httpResp, resp, c.MaxResponseBodySize, stream); err != nil {
+		return err
+	}
+	setRequestProtocol(ctx, httpResp.Proto)
+	if info := requestInfoFromContext(ctx); info != nil {
+		info.TLS = httpResp.TLS
+		info.Uncompressed = httpResp.Uncompressed
+	}
+	return nil
 }
 
-func (c *Client) SetProxyHTTP(proxy string) {
-	if c == nil {
-		return
+func (c *Client) doFollowRedirectsBuffer(ctx context.Context, req *Request, dst []byte, url string) (int, []byte, error) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	do := func(req *Request, resp *Response) error {
+		return c.roundTrip(ctx, req, resp)
+	}
+	statusCode, err := doRequestFollowRedirects(req, resp, url, defaultMaxRedirectsCount, do)
+	if err == nil && resp.IsBodyStream() {
+		var body []byte
+		body, err = responseBody(resp)
+		return statusCode, append(dst[:0], body...), err
 	}
-	c.Client.Dial = fasthttpproxy.FasthttpHTTPDialer(proxy)
+	return statusCode, append(dst[:0], resp.Body()...), err
+}
 
-	tr := trFromHTTPClient(c.httpClient)
-	if tr == nil {
-		return
+// SetProxyHTTP routes requests through an http:// or https:// proxy. On
+// error the client keeps its previous proxy.
+func (c *Client) SetProxyHTTP(proxy string) error {
+	return c.setProxy(proxy, "http", "http", "https")
+}
+
+// SetSOCKS5Proxy routes requests through a socks5:// or socks5h:// proxy.
+// On error the client keeps its previous proxy.
+func (c *Client) SetSOCKS5Proxy(proxyAddr string) error {
+	return c.setProxy(proxyAddr, "socks5", "socks5", "socks5h")
+}
+
+// SetMASQUEProxy sends HTTP/3 requests through a MASQUE proxy
+// (masque://[user:pass@]host[:port][/template]) using CONNECT-UDP. MASQUE
+// proxies can't carry TCP, so requests of other HTTP versions fail.
+func (c *Client) SetMASQUEProxy(proxy string) error {
+	return c.setProxy(proxy, "masque", "masque")
+}
+
+// setProxy parses proxy, which defaults to defaultScheme, and uses it if its
+// scheme is one of schemes, or any scheme if none are given.
+func (c *Client) setProxy(proxy, defaultScheme string, schemes ...string) error {
+	if c == nil {
+		return nil
 	}
-	u, err := parseProxyURL(proxy, "http")
+	p, err := parseProxy(proxy, defaultScheme)
 	if err != nil {
-		return
+		return err
+	}
+	if len(schemes) > 0 && !slices.Contains(schemes, p.Scheme) {
+		return fmt.Errorf("proxy %s: expected a %s proxy", p, strings.Join(schemes, " or "))
 	}
-	tr.Proxy = http.ProxyURL(u)
+	return c.useProxies([]ProxySpec{p})
 }
 
-func (c *Client) SetSOCKS5Proxy(proxyAddr string) {
+// SetProxyChain routes requests through each proxy of chain in turn: the
+// client connects to the first one, which tunnels to the second, and so on
+// to the target. Proxies of any scheme but masque can be chained. An empty
+// chain is the same as ClearProxy.
+func (c *Client) SetProxyChain(chain []string) error {
 	if c == nil {
-		return
+		return nil
+	}
+	if len(chain) == 0 {
+		c.ClearProxy()
+		return nil
+	}
+	proxies := make([]ProxySpec, len(chain))
+	for i, proxy := range chain {
+		p, err := parseProxy(proxy, "http")
+		if err != nil {
+			return err
+		}
+		proxies[i] = p
+	}
+	return c.useProxies(proxies)
+}
+
+// useProxies switches every transport to the proxy chain. Idle connections
+// made through the previous proxies are closed.
+func (c *Client) useProxies(chain []ProxySpec) error {
+	dial, err := chainDialer(chain, c.TLSConfig)
+	if err != nil {
+		return err
+	}
+	p := chain[0]
+	c.updateTransports(func(t *clientTransports) {
+		t.proxies, t.pac = chain, nil
+		t.dial = dial
+		if c.h3Transport() != nil {
+			switch {
+			case len(chain) > 1:
+				// UDP can't be relayed through a TCP tunnel.
+				c.routeTCPOnly(t, errProxyChainNoUDP)
+			case p.Scheme == "masque":
+				t.h3Dial = newMASQUEDialer(p, c.TLSConfig).dialQUIC
+				t.race, t.h2 = nil, nil
+				c.h3Downgrade.Store(nil)
+			case p.Scheme == "socks5" || p.Scheme == "socks5h":
+				t.h3Dial = newSOCKS5UDPDialer(p, dialDirect).dialQUIC
+				c.enableHTTP2Fallback(t)
+				c.h3Downgrade.Store(nil)
+			default:
+				c.routeTCPOnly(t, proxyNoUDPError(p))
+			}
+		}
+		if len(chain) == 1 && (p.Scheme == "http" || p.Scheme == "https") {
+			t.httpProxy, t.httpDial = http.ProxyURL(p.URL()), nil
+		} else {
+			t.httpProxy, t.httpDial = nil, dial
+		}
+	})
+	return nil
+}
+
+func dialMASQUENoTCP(context.Context, string, string) (net.Conn, error) {
+	return nil, errMASQUENoTCP
+}
+
+var (
+	errHTTPProxyNoUDP   = fmt.Errorf("%w: HTTP proxies can only tunnel TCP", ErrProxyUDPUnsupported)
+	errSOCKS4ProxyNoUDP = fmt.Errorf("%w: SOCKS4 proxies can only tunnel TCP", ErrProxyUDPUnsupported)
+	errProxyChainNoUDP  = fmt.Errorf("%w: proxy chains can only tunnel TCP", ErrProxyUDPUnsupported)
+	errRoutingNoUDP     = fmt.Errorf("%w: proxy rules and environment proxies only route TCP", ErrProxyUDPUnsupported)
+)
+
+func proxyNoUDPError(p ProxySpec) error {
+	if p.Scheme == "socks4" || p.Scheme == "socks4a" {
+		return errSOCKS4ProxyNoUDP
+	}
+	return errHTTPProxyNoUDP
+}
+
+// h3Transport returns the HTTP/3 transport of an HTTP3 client.
+func (c *Client) h3Transport() *http3.Transport {
+	if c.httpVersion != HTTP3 || c.httpClient == nil {
+		return nil
 	}
-	c.Client.Dial = fasthttpproxy.FasthttpSocksDialer(proxyAddr)
+	tr, _ := c.httpClient.Transport.(*http3.Transport)
+	return tr
+}
 
-	tr := trFromHTTPClient(c.httpClient)
-	if tr == nil {
+// routeTCPOnly makes an HTTP3 client send its requests over HTTP/2, for a
+// proxy setting that can't route its QUIC connections; err says why.
+func (c *Client) routeTCPOnly(t *clientTransports, err error) {
+	if c.h3Transport() == nil {
 		return
 	}
-	setHTTPClientSOCKS5(tr, proxyAddr)
+	t.h3Dial = nil
+	c.enableHTTP2Fallback(t)
+	c.h3Downgrade.Store(&h3DowngradeState{err: err})
+}
+
+// enableHTTP2Fallback lets a proxied HTTP3 client fall back to HTTP/2 over
+// the proxy. Racing is for direct connections only.
+func (c *Client) enableHTTP2Fallback(t *clientTransports) {
+	t.race = nil
+	if t.h2 == nil {
+		t.h2 = newH2Transport(c)
+	}
 }
 
-func (c *Client) SetProxy(proxy string) {
+// SetProxy routes requests through proxy, of any scheme ParseProxy accepts.
+// An empty proxy is the same as ClearProxy.
+func (c *Client) SetProxy(proxy string) error {
 	if proxy == "" {
-		c.Client.Dial = nil
-		return
+		c.ClearProxy()
+		return nil
 	}
-	if strings.HasPrefix(proxy, "socks5://") {
-		c.SetSOCKS5Proxy(proxy)
+	return c.setProxy(proxy, "http")
+}
+
+// ClearProxy makes every transport connect directly again and closes the
+// idle connections made through the proxy.
+func (c *Client) ClearProxy() {
+	if c == nil {
 		return
 	}
-	c.SetProxyHTTP(proxy)
+	c.updateTransports(func(t *clientTransports) {
+		t.proxies, t.dial, t.pac = nil, nil, nil
+		t.httpProxy, t.httpDial = nil, nil
+		if c.h3Transport() != nil {
+			t.h3Dial = nil
+			if c.h3Race && t.race == nil {
+				if t.h2 == nil {
+					t.h2 = newH2Transport(c)
+				}
+				t.race = newH3Racer(c, t.h2, c.h3RaceDelay)
+				t.h3Dial = t.race.dialH3
+			}
+			c.h3Downgrade.Store(nil)
+		}
+	})
 }
 
-func (c *Client) SetProxyFromEnvironment() {
+// CurrentProxy returns the proxy set with one of the proxy setters (the
+// first hop of a chain), or false if the client connects directly or uses
+// the environment's proxies.
+func (c *Client) CurrentProxy() (ProxySpec, bool) {
+	chain := c.CurrentProxyChain()
+	if len(chain) == 0 {
+		return ProxySpec{}, false
+	}
+	return chain[0], true
+}
+
+// CurrentProxyChain returns the proxies requests go through, in order.
+func (c *Client) CurrentProxyChain() []ProxySpec {
 	if c == nil {
-		return
+		return nil
 	}
-	c.Client.Dial = fasthttpproxy.FasthttpProxyHTTPDialer()
+	return slices.Clone(c.current().proxies)
+}
 
-	tr := trFromHTTPClient(c.httpClient)
-	if tr == nil {
+// SetProxyFromEnvironment routes requests through the proxies of the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. HTTP3 clients
+// send their requests over HTTP/2, as the variables only cover TCP.
+func (c *Client) SetProxyFromEnvironment() {
+	if c == nil {
 		return
 	}
-	tr.Proxy = http.ProxyFromEnvironment
+	c.updateTransports(func(t *clientTransports) {
+		t.proxies, t.dial, t.pac = nil, envProxyDialer(0), nil
+		t.httpProxy, t.httpDial = http.ProxyFromEnvironment, nil
+		c.routeTCPOnly(t, errRoutingNoUDP)
+	})
 }
 
 func (c *Client) SetProxyFromEnvironmentTimeout(timeout time.Duration) {
 	if c == nil {
 		return
 	}
-	c.Client.Dial = fasthttpproxy.FasthttpProxyHTTPDialerTimeout(timeout)
+	c.updateTransports(func(t *clientTransports) {
+		t.proxies, t.dial, t.pac = nil, envProxyDialer(timeout), nil
+		t.httpProxy, t.httpDial = http.ProxyFromEnvironment, nil
+		c.routeTCPOnly(t, errRoutingNoUDP)
+	})
+	if timeout > 0 && c.httpClient != nil && c.httpClient.Timeout == 0 {
+		c.httpClient.Timeout = timeout
+	}
+}
+
+// SetProxyPAC routes requests as the proxy auto-config script decides.
+// pac is the script itself or an http(s) URL to fetch it from. The script's
+// FindProxyForURL runs for every request with its full URL (answers are
+// cached per URL for a minute), and the request goes through the first of
+// the answers (DIRECT, PROXY, HTTPS, SOCKS, SOCKS5) that can be reached, as
+// if set with WithProxy. HTTP/3 requests go over HTTP/2 through proxies
+// that can't carry UDP.
+func (c *Client) SetProxyPAC(pac string) error {
+	if c == nil {
+		return nil
+	}
+	src, err := c.loadPAC(pac)
+	if err != nil {
+		return err
+	}
+	script, err := newPACScript(src)
+	if err != nil {
+		return err
+	}
+	c.updateTransports(func(t *clientTransports) {
+		t.proxies, t.dial, t.pac = nil, nil, script
+		t.httpProxy, t.httpDial = nil, nil
+		if c.h3Transport() != nil {
+			// Each request gets its HTTP/3 dialer from its proxy.
+			t.h3Dial, t.race = nil, nil
+			c.h3Downgrade.Store(nil)
+		}
+	})
+	return nil
+}
 
-	tr := trFromHTTPClient(c.httpClient)
-	if tr == nil {
+// SetProxyRules routes each new connection as rules say. Rules only route
+// TCP, so HTTP3 clients send their requests over HTTP/2. A nil rules is the
+// same as ClearProxy.
+func (c *Client) SetProxyRules(rules *ProxyRules) {
+	if c == nil {
 		return
 	}
-	tr.Proxy = http.ProxyFromEnvironment
-	if timeout > 0 && c.httpClient.Timeout == 0 {
-		c.httpClient.Timeout = timeout
+	if rules == nil {
+		c.ClearProxy()
+		return
 	}
+	c.updateTransports(func(t *clientTransports) {
+		tlsConfig := sessionsVia(c.TLSConfig, nil)
+		t.proxies, t.dial, t.pac = nil, rules.dialer(dialDirect, tlsConfig), nil
+		t.httpProxy, t.httpDial = rules.netHTTPProxy, rules.netHTTPDialer(dialDirect, tlsConfig)
+		c.routeTCPOnly(t, errRoutingNoUDP)
+	})
 }
 
 func (c *Client) DoBytes(method, url string, body []byte) ([]byte, int, error) {
@@ -186,9 +642,28 @@ func (c *Client) DoBytes(method, url string, body []byte) ([]byte, int, error) {
 	if err := c.Do(&req, &resp); err != nil {
 		return nil, 0, err
 	}
-	b := resp.Body()
-	out := make([]byte, len(b))
-	copy(out, b)
+	out, err := responseBody(&resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, resp.StatusCode(), nil
+}
+
+func (c *Client) DoBytesCtx(ctx context.Context, method, url string, body []byte) ([]byte, int, error) {
+	var req Request
+	var resp Response
+	req.SetRequestURI(url)
+	req.Header.SetMethod(method)
+	if len(body) != 0 {
+		req.SetBody(body)
+	}
+	if err := c.DoCtx(ctx, &req, &resp); err != nil {
+		return nil, 0, err
+	}
+	out, err := responseBody(&resp)
+	if err != nil {
+		return nil, 0, err
+	}
 	return out, resp.StatusCode(), nil
 }
 
@@ -203,9 +678,10 @@ func (c *Client) DoBytesTimeout(method, url string, body []byte, timeout time.Du
 	if err := c.DoTimeout(&req, &resp, timeout); err != nil {
 		return nil, 0, err
 	}
-	b := resp.Body()
-	out := make([]byte, len(b))
-	copy(out, b)
+	out, err := responseBody(&resp)
+	if err != nil {
+		return nil, 0, err
+	}
 	return out, resp.StatusCode(), nil
 }
 
@@ -239,9 +715,31 @@ func (c *Client) PostJSON(url string, v any) ([]byte, int, error) {
 	if err := c.Do(&req, &resp); err != nil {
 		return nil, 0, err
 	}
-	b := resp.Body()
-	out := make([]byte, len(b))
-	copy(out, b)
+	out, err := responseBody(&resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, resp.StatusCode(), nil
+}
+
+func (c *Client) PostJSONCtx(ctx context.Context, url string, v any) ([]byte, int, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, 0, err
+	}
+	var req Request
+	var resp Response
+	req.SetRequestURI(url)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.SetBody(data)
+	if err := c.DoCtx(ctx, &req, &resp); err != nil {
+		return nil, 0, err
+	}
+	out, err := responseBody(&resp)
+	if err != nil {
+		return nil, 0, err
+	}
 	return out, resp.StatusCode(), nil
 }
 
@@ -259,9 +757,10 @@ func (c *Client) PostJSONTimeout(url string, v any, timeout time.Duration) ([]by
 	if err := c.DoTimeout(&req, &resp, timeout); err != nil {
 		return nil, 0, err
 	}
-	b := resp.Body()
-	out := make([]byte, len(b))
-	copy(out, b)
+	out, err := responseBody(&resp)
+	if err != nil {
+		return nil, 0, err
+	}
 	return out, resp.StatusCode(), nil
 }
 
@@ -329,6 +828,7 @@ func PostStringTimeoutURL(url string, body []byte, timeout time.Duration) (strin
 	return string(b), status, err
 }
 
+// ClientOptions configure a client built with NewClientWithOptions.
 type ClientOptions struct {
 	HTTPVersion                   HTTPVersion
 	MaxConnsPerHost               int
@@ -347,17 +847,29 @@ type ClientOptions struct {
 	TLSConfig                     *tls.Config
 	ProxyHTTP                     string
 	SOCKS5Proxy                   string
+	MASQUEProxy                   string
+	ProxyChain                    []string
+	DisableNativeHTTP2            bool
+	H2C                           bool
+	HTTP3Race                     bool
+	HTTP3RaceDelay                time.Duration
+	HTTP3Options                  HTTP3Options
+	SessionCache                  *SessionCache
 }
 
+// NewClientWithOptions returns a client configured by opt. If a proxy of opt
+// is invalid, the client's requests fail instead of connecting directly.
 func NewClientWithOptions(opt ClientOptions) *Client {
 	c := &Client{}
 
 	if opt.HTTPVersion == 0 {
 		opt.HTTPVersion = HTTP1
 	}
-	if opt.HTTPVersion == HTTP3 && (opt.ProxyHTTP != "" || opt.SOCKS5Proxy != "") {
-		// HTTP/3 over HTTP/SOCKS5 proxies isn't supported; fall back to HTTP/2.
+	if opt.HTTPVersion == HTTP3 && opt.ProxyHTTP != "" {
+		// HTTP proxies can't carry QUIC; fall back to HTTP/2. SOCKS5 proxies
+		// are tried with UDP ASSOCIATE first.
 		opt.HTTPVersion = HTTP2
+		c.h3Downgrade.Store(&h3DowngradeState{err: errHTTPProxyNoUDP})
 	}
 	c.httpVersion = opt.HTTPVersion
 
@@ -399,16 +911,59 @@ func NewClientWithOptions(opt ClientOptions) *Client {
 		c.MaxConnWaitTimeout = opt.MaxConnWaitTimeout
 	}
 	c.TLSConfig = opt.TLSConfig
+	if opt.HTTPVersion == HTTP3 || opt.HTTPVersion == HTTPAuto {
+		if pc := opt.HTTP3Options.PacketConn; pc != nil {
+			c.quicTransport = &quic.Transport{Conn: pc}
+		}
+		c.h3ZeroRTT = opt.HTTP3Options.Enable0RTT
+	}
 
-	if opt.HTTPVersion == HTTP2 || opt.HTTPVersion == HTTP3 {
+	t := &clientTransports{}
+	switch opt.HTTPVersion {
+	case HTTP2, HTTP3:
 		c.httpClient = newHTTPClient(opt.HTTPVersion, opt)
+		if opt.HTTPVersion == HTTP2 && !opt.DisableNativeHTTP2 {
+			t.h2 = newH2Transport(c)
+			t.h2.cleartext = opt.H2C
+		}
+		if opt.HTTPVersion == HTTP3 && opt.HTTP3Race {
+			t.h2 = newH2Transport(c)
+			t.race = newH3Racer(c, t.h2, opt.HTTP3RaceDelay)
+			t.h3Dial = t.race.dialH3
+			c.h3Race, c.h3RaceDelay = true, opt.HTTP3RaceDelay
+		}
+	case HTTPAuto:
+		c.altSvc = &altSvcCache{dial: c.dialQUIC}
+		c.httpClient = newHTTPClient(HTTP3, opt)
+		c.httpClient.Transport.(*http3.Transport).Dial = c.altSvc.dialAltSvc
+		t.h2 = newH2Transport(c)
+	}
+	c.transports.Store(t)
+	c.useTransportHooks()
+
+	var proxyErr error
+	keep := func(err error) {
+		if proxyErr == nil {
+			proxyErr = err
+		}
 	}
-
 	if opt.ProxyHTTP != "" {
-		c.SetProxyHTTP(opt.ProxyHTTP)
+		keep(c.SetProxyHTTP(opt.ProxyHTTP))
 	}
 	if opt.SOCKS5Proxy != "" {
-		c.SetSOCKS5Proxy(opt.SOCKS5Proxy)
+		keep(c.SetSOCKS5Proxy(opt.SOCKS5Proxy))
+	}
+	if opt.MASQUEProxy != "" {
+		keep(c.SetMASQUEProxy(opt.MASQUEProxy))
+	}
+	if len(opt.ProxyChain) > 0 {
+		keep(c.SetProxyChain(opt.ProxyChain))
+	}
+	if proxyErr != nil {
+		c.refuseRequests(proxyErr)
+	}
+	if opt.SessionCache != nil {
+		c.SetSessionCache(opt.SessionCache)
 	}
 
 	return c
@@ -437,10 +992,19 @@ func newHTTPClient(version HTTPVersion, opt ClientOptions) *http.Client {
 		if opt.WriteBufferSize > 0 {
 			tr.WriteBufferSize = opt.WriteBufferSize
 		}
-		_ = http2.ConfigureTransport(tr)
+		if opt.H2C {
+			// Without HTTP/1 net/http uses HTTP/2 with prior knowledge for
+			// http:// URLs.
+			tr.Protocols = new(http.Protocols)
+			tr.Protocols.SetHTTP2(true)
+			tr.Protocols.SetUnencryptedHTTP2(true)
+		} else {
+			_ = http2.ConfigureTransport(tr)
+		}
 
 		client := &http.Client{
-			Transport: tr,
+			Transport:     tr,
+			CheckRedirect: noFollowRedirects,
 		}
 		if timeout > 0 {
 			client.Timeout = timeout
@@ -448,10 +1012,13 @@ func newHTTPClient(version HTTPVersion, opt ClientOptions) *http.Client {
 		return client
 	case HTTP3:
 		rt := &http3.Transport{
-			TLSClientConfig: opt.TLSConfig,
+			TLSClientConfig: newH3TLSConfig(opt),
+			QUICConfig:      newQUICConfig(opt),
+			EnableDatagrams: opt.HTTP3Options.EnableDatagrams,
 		}
 		client := &http.Client{
-			Transport: rt,
+			Transport:     rt,
+			CheckRedirect: noFollowRedirects,
 		}
 		if timeout > 0 {
 			client.Timeout = timeout
@@ -462,6 +1029,9 @@ func newHTTPClient(version HTTPVersion, opt ClientOptions) *http.Client {
 	}
 }
 
+// NewHighPerfClient returns an HTTP/1 client tuned for throughput, going
+// through proxy unless it is "". If proxy is invalid, the client's requests
+// fail instead of connecting directly.
 func NewHighPerfClient(proxy string) *Client {
 	opt := ClientOptions{
 		HTTPVersion:                   HTTP1,
@@ -475,47 +1045,15 @@ func NewHighPerfClient(proxy string) *Client {
 	}
 	c := NewClientWithOptions(opt)
 	if proxy != "" {
-		c.SetProxy(proxy)
-	}
-	return c
-}
-
-type ClientPool struct {
-	clients []*Client
-	idx     uint32
-}
-
-func NewClientPool(size int, factory func() *Client) *ClientPool {
-	if size <= 0 {
-		size = 1
-	}
-	clients := make([]*Client, size)
-	for i := 0; i < size; i++ {
-		c := factory()
-		if c == nil {
-			c = &Client{}
+		if err := c.SetProxy(proxy); err != nil {
+			c.refuseRequests(err)
 		}
-		clients[i] = c
-	}
-	return &ClientPool{clients: clients}
-}
-
-func (p *ClientPool) Next() *Client {
-	if p == nil || len(p.clients) == 0 {
-		return nil
-	}
-	i := atomic.AddUint32(&p.idx, 1)
-	return p.clients[i%uint32(len(p.clients))]
-}
-
-func (p *ClientPool) Do(req *Request, resp *Response) error {
-	c := p.Next()
-	if c == nil {
-		return fasthttp.ErrNoFreeConns
 	}
-	return c.Do(req, resp)
+	return c
 }
 
+// NewProxyClientPool returns a pool of perProxy clients for each of proxies.
+// The clients of an invalid proxy fail their requests.
 func NewProxyClientPool(proxies []string, perProxy int) *ClientPool {
 	if len(proxies) == 0 {
 		return nil
@@ -530,7 +1068,7 @@ func NewProxyClientPool(proxies []string, perProxy int) *ClientPool {
 			clients = append(clients, NewHighPerfClient(pxy))
 		}
 	}
-	return &ClientPool{clients: clients}
+	return newClientPool(clients, nil)
 }
 
 func NewHighPerfClientPool(size int, proxy string) *ClientPool {
@@ -539,16 +1077,39 @@ func NewHighPerfClientPool(size int, proxy string) *ClientPool {
 	})
 }
 
-func convertRequestToHTTP(req *Request) (*http.Request, error) {
+// netHTTPHeaders are the request headers net/http looks up by their canonical
+// name, so they can't be passed with their original casing.
+var netHTTPHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Expect":            true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Range":             true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"User-Agent":        true,
+}
+
+// convertRequestToHTTP builds the net/http request for req. http.Header is a
+// map, so header order can't be kept: HTTP/2 and HTTP/3 send the names
+// lowercased (as the protocols require) in map order, and HTTP/1.1 sends them
+// sorted. With rawNames the names keep their casing over HTTP/1.1.
+func convertRequestToHTTP(req *Request, rawNames bool) (*http.Request, error) {
 	if req == nil {
 		return nil, errors.New("nil request")
 	}
 	uri := req.URI()
 	urlStr := string(uri.FullURI())
 
-	body := req.Body()
 	var bodyReader io.Reader
-	if len(body) > 0 {
+	if req.IsBodyStream() {
+		// The stream stays owned by req, which closes it on reset.
+		bodyReader = io.NopCloser(req.BodyStream())
+	} else if body := req.Body(); len(body) > 0 {
 		bodyReader = bytes.NewReader(body)
 	}
 
@@ -556,6 +1117,14 @@ func convertRequestToHTTP(req *Request) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
+	if req.IsBodyStream() {
+		// -1 sends the body chunked (HTTP/1.1) or without a length (HTTP/2
+		// and HTTP/3).
+		httpReq.ContentLength = int64(req.Header.ContentLength())
+		if httpReq.ContentLength < 0 {
+			httpReq.ContentLength = -1
+		}
+	}
 
 	req.Header.VisitAll(func(k, v []byte) {
 		key := string(k)
@@ -564,41 +1133,201 @@ func convertRequestToHTTP(req *Request) (*http.Request, error) {
 			httpReq.Host = value
 			return
 		}
+		if rawNames && !netHTTPHeaders[http.CanonicalHeaderKey(key)] {
+			httpReq.Header[key] = append(httpReq.Header[key], value)
+			return
+		}
 		httpReq.Header.Add(key, value)
 	})
 
 	return httpReq, nil
 }
 
-func convertHTTPResponse(httpResp *http.Response, resp *Response) error {
+// convertHTTPResponse copies httpResp into resp. With stream set the body
+// becomes resp's body stream, which closes it; otherwise it is read in full,
+// failing with fasthttp.ErrBodyTooLarge beyond maxBodySize (if > 0).
+func convertHTTPResponse(httpResp *http.Response, resp *Response, maxBodySize int, stream bool) error {
 	if httpResp == nil || resp == nil {
 		return nil
 	}
-	defer httpResp.Body.Close()
-
 	resp.Reset()
+	resp.StreamBody = stream
+	resp.Header.SetProtocol([]byte(httpResp.Proto))
 	resp.SetStatusCode(httpResp.StatusCode)
 	for k, values := range httpResp.Header {
 		for _, v := range values {
 			resp.Header.Add(k, v)
 		}
 	}
-	body, err := io.ReadAll(httpResp.Body)
+	for k := range httpResp.Trailer {
+		_ = resp.Header.AddTrailer(k)
+	}
+	if stream {
+		resp.SetBodyStream(&trailerReader{httpResp: httpResp, resp: resp}, int(httpResp.ContentLength))
+		return nil
+	}
+	defer httpResp.Body.Close()
+
+	if maxBodySize > 0 && httpResp.ContentLength > int64(maxBodySize) {
+		return fasthttp.ErrBodyTooLarge
+	}
+	var r io.Reader = httpResp.Body
+	if maxBodySize > 0 {
+		r = io.LimitReader(r, int64(maxBodySize)+1)
+	}
+	body, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	if maxBodySize > 0 && len(body) > maxBodySize {
+		return fasthttp.ErrBodyTooLarge
+	}
 	resp.SetBody(body)
+	if httpResp.ContentLength < 0 {
+		// Like fasthttp after reading a chunked body.
+		resp.Header.SetContentLength(len(body))
+	}
+	copyTrailers(httpResp.Trailer, resp)
 	return nil
 }
 
-func parseProxyURL(proxyStr, defaultScheme string) (*url.URL, error) {
-	if proxyStr == "" {
-		return nil, errors.New("empty proxy")
+// trailerReader is the body stream of a converted response. net/http only
+// fills in the trailers once the body is read to the end.
+type trailerReader struct {
+	httpResp *http.Response
+	resp     *Response
+	done     bool
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	n, err := r.httpResp.Body.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		copyTrailers(r.httpResp.Trailer, r.resp)
+	}
+	return n, err
+}
+
+func (r *trailerReader) Close() error {
+	return r.httpResp.Body.Close()
+}
+
+type streamCancelKey struct{}
+
+// deadlineBody returns body so that it cancels the context the request was
+// sent with, if set by DoDeadline, once read to the end or closed.
+func deadlineBody(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	if cancel, ok := ctx.Value(streamCancelKey{}).(context.CancelFunc); ok {
+		return &cancelBody{ReadCloser: body, cancel: cancel}
+	}
+	return body
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.cancel()
+	}
+	return n, err
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// copyTrailers adds trailer values to resp's header, where fasthttp keeps
+// them, declaring the trailers the server didn't announce.
+func copyTrailers(trailer http.Header, resp *Response) {
+	for k, values := range trailer {
+		if len(values) == 0 {
+			continue
+		}
+		if !hasTrailerKey(resp, k) {
+			if err := resp.Header.AddTrailer(k); err != nil {
+				continue
+			}
+		}
+		for _, v := range values {
+			resp.Header.Add(k, v)
+		}
 	}
-	if !strings.Contains(proxyStr, "://") {
-		proxyStr = defaultScheme + "://" + proxyStr
+}
+
+func hasTrailerKey(resp *Response, key string) bool {
+	for _, k := range resp.Header.PeekTrailerKeys() {
+		if strings.EqualFold(string(k), key) {
+			return true
+		}
 	}
-	return url.Parse(proxyStr)
+	return false
+}
+
+// responseBody returns a copy of resp's body, reading (and closing) the body
+// stream of a streamed response.
+func responseBody(resp *Response) ([]byte, error) {
+	if resp.IsBodyStream() {
+		defer resp.CloseBodyStream()
+		return io.ReadAll(resp.BodyStream())
+	}
+	b := resp.Body()
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out, nil
+}
+
+// Do never follows redirects on the fasthttp path, so the net/http clients
+// hand back the redirect response as-is and let DoRedirects/Get/Post follow.
+func noFollowRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+const defaultMaxRedirectsCount = 16
+
+func doRequestFollowRedirects(req *Request, resp *Response, url string, maxRedirectsCount int, do func(*Request, *Response) error) (statusCode int, err error) {
+	redirectsCount := 0
+	for {
+		req.SetRequestURI(url)
+		if err = do(req, resp); err != nil {
+			return 0, err
+		}
+		statusCode = resp.StatusCode()
+		if !fasthttp.StatusCodeIsRedirect(statusCode) {
+			return statusCode, nil
+		}
+
+		redirectsCount++
+		if redirectsCount > maxRedirectsCount {
+			return statusCode, fasthttp.ErrTooManyRedirects
+		}
+		location := resp.Header.Peek(fasthttp.HeaderLocation)
+		if len(location) == 0 {
+			return statusCode, fasthttp.ErrMissingLocation
+		}
+		url = redirectURL(url, location, req.DisableRedirectPathNormalizing)
+	}
+}
+
+func redirectURL(baseURL string, location []byte, disablePathNormalizing bool) string {
+	u := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(u)
+	u.Update(baseURL)
+	u.UpdateBytes(location)
+	u.DisablePathNormalizing = disablePathNormalizing
+	return u.String()
+}
+
+func timeoutError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fasthttp.ErrTimeout
+	}
+	return err
 }
 
 func trFromHTTPClient(c *http.Client) *http.Transport {
@@ -612,21 +1341,6 @@ func trFromHTTPClient(c *http.Client) *http.Transport {
 	return tr
 }
 
-func setHTTPClientSOCKS5(tr *http.Transport, proxyAddr string) {
-	if tr == nil || proxyAddr == "" {
-		return
-	}
-	addr := strings.TrimPrefix(proxyAddr, "socks5://")
-	dialer, err := xnetproxy.SOCKS5("tcp", addr, nil, xnetproxy.Direct)
-	if err != nil {
-		return
-	}
-	tr.Proxy = nil
-	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dialer.Dial(network, addr)
-	}
-}
-
 func NewProxyClientPoolFromString(list string, perProxy int) *ClientPool {
 	if list == "" {
 		return nil
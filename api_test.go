@@ -1,12 +1,21 @@
 package v2fasthttp
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/quic-go/quic-go/http3"
+	"github.com/valyala/fasthttp"
 )
 
 func TestNewClientWithOptionsDefaults(t *testing.T) {
@@ -64,6 +73,65 @@ func TestNewClientWithOptionsHTTP3(t *testing.T) {
 	}
 }
 
+func TestNewClientWithOptionsHTTP3Tuning(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer pc.Close()
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion:         HTTP3,
+		MaxIdleConnDuration: 45 * time.Second,
+		HTTP3Options: HTTP3Options{
+			KeepAlivePeriod:                10 * time.Second,
+			MaxIncomingStreams:             7,
+			InitialStreamReceiveWindow:     1 << 20,
+			MaxStreamReceiveWindow:         4 << 20,
+			InitialConnectionReceiveWindow: 2 << 20,
+			MaxConnectionReceiveWindow:     8 << 20,
+			Enable0RTT:                     true,
+			EnableDatagrams:                true,
+			PacketConn:                     pc,
+		},
+	})
+
+	rt := c.h3Transport()
+	if rt == nil {
+		t.Fatalf("expected http3.Transport for HTTP3 client")
+	}
+	cfg := rt.QUICConfig
+	if cfg == nil {
+		t.Fatalf("expected a QUIC config")
+	}
+	if cfg.MaxIdleTimeout != 45*time.Second {
+		t.Fatalf("expected MaxIdleConnDuration as QUIC idle timeout, got %v", cfg.MaxIdleTimeout)
+	}
+	if cfg.KeepAlivePeriod != 10*time.Second || cfg.MaxIncomingStreams != 7 {
+		t.Fatalf("keep-alive/streams not propagated: %v, %d", cfg.KeepAlivePeriod, cfg.MaxIncomingStreams)
+	}
+	if cfg.InitialStreamReceiveWindow != 1<<20 || cfg.MaxStreamReceiveWindow != 4<<20 ||
+		cfg.InitialConnectionReceiveWindow != 2<<20 || cfg.MaxConnectionReceiveWindow != 8<<20 {
+		t.Fatalf("flow-control windows not propagated: %+v", cfg)
+	}
+	if !cfg.EnableDatagrams || !rt.EnableDatagrams {
+		t.Fatalf("expected datagrams to be enabled")
+	}
+	if rt.TLSClientConfig == nil || rt.TLSClientConfig.ClientSessionCache == nil || !c.h3ZeroRTT {
+		t.Fatalf("expected 0-RTT to set up session resumption")
+	}
+	if c.quicTransport == nil || c.quicTransport.Conn != pc || rt.Dial == nil {
+		t.Fatalf("expected QUIC to be dialed over the custom PacketConn")
+	}
+
+	c = NewClientWithOptions(ClientOptions{
+		HTTPVersion:  HTTP3,
+		HTTP3Options: HTTP3Options{MaxIdleTimeout: 5 * time.Second},
+	})
+	if got := c.h3Transport().QUICConfig.MaxIdleTimeout; got != 5*time.Second {
+		t.Fatalf("expected explicit MaxIdleTimeout to win, got %v", got)
+	}
+}
+
 func TestNewClientWithOptionsHTTP3WithProxyFallsBackToHTTP2(t *testing.T) {
 	c := NewClientWithOptions(ClientOptions{
 		HTTPVersion: HTTP3,
@@ -92,21 +160,27 @@ func TestNewClientWithOptionsHTTP3WithProxyFallsBackToHTTP2(t *testing.T) {
 	}
 }
 
-func TestNewClientWithOptionsHTTP3WithSocksProxyFallsBackToHTTP2(t *testing.T) {
+func TestNewClientWithOptionsHTTP3WithSocksProxyKeepsHTTP3(t *testing.T) {
 	c := NewClientWithOptions(ClientOptions{
 		HTTPVersion: HTTP3,
 		SOCKS5Proxy: "socks5://127.0.0.1:9050",
 	})
 
-	if c.httpVersion != HTTP2 {
-		t.Fatalf("expected fallback to HTTP2 when HTTP3 + SOCKS5 proxy, got %v", c.httpVersion)
+	if c.httpVersion != HTTP3 {
+		t.Fatalf("expected HTTP3 to be kept with a SOCKS5 proxy, got %v", c.httpVersion)
 	}
-	tr := trFromHTTPClient(c.httpClient)
+	tr := c.h3Transport()
 	if tr == nil {
-		t.Fatalf("expected *http.Transport after fallback")
+		t.Fatalf("expected *http3.Transport")
+	}
+	if tr.Dial == nil {
+		t.Fatalf("expected Dial to go through SOCKS5 UDP ASSOCIATE")
 	}
-	if tr.DialContext == nil {
-		t.Fatalf("expected DialContext to be set for SOCKS5 transport after fallback")
+	if c.current().h2 == nil {
+		t.Fatalf("expected an HTTP/2 fallback in case the proxy refuses UDP")
+	}
+	if err := c.HTTP3Downgrade(); err != nil {
+		t.Fatalf("unexpected downgrade before any request: %v", err)
 	}
 }
 
@@ -138,22 +212,20 @@ func TestSetSOCKS5ProxyConfiguresDialContext(t *testing.T) {
 		HTTPVersion: HTTP2,
 	})
 
-	tr := trFromHTTPClient(c.httpClient)
-	if tr == nil {
+	if trFromHTTPClient(c.httpClient) == nil {
 		t.Fatalf("expected *http.Transport")
 	}
 
-	if tr.DialContext != nil {
+	if c.current().httpDial != nil {
 		t.Fatalf("expected DialContext to be nil before SetSOCKS5Proxy")
 	}
 
 	c.SetSOCKS5Proxy("socks5://127.0.0.1:9050")
 
-	tr = trFromHTTPClient(c.httpClient)
-	if tr.DialContext == nil {
+	if c.current().httpDial == nil {
 		t.Fatalf("expected DialContext to be set after SetSOCKS5Proxy")
 	}
-	if tr.Proxy != nil {
+	if c.current().httpProxy != nil {
 		t.Fatalf("expected Proxy to be nil for SOCKS5 transport")
 	}
 }
@@ -185,6 +257,9 @@ func TestUseNetHTTPBehaviour(t *testing.T) {
 	if c4.httpVersion != HTTP2 {
 		t.Fatalf("expected HTTP2 after fallback, got %v", c4.httpVersion)
 	}
+	if !errors.Is(c4.HTTP3Downgrade(), ErrProxyUDPUnsupported) {
+		t.Fatalf("expected the fallback to be reported, got %v", c4.HTTP3Downgrade())
+	}
 	if !c4.useNetHTTP() {
 		t.Fatalf("expected useNetHTTP to be true after HTTP3+proxy fallback to HTTP2")
 	}
@@ -203,3 +278,317 @@ func TestNewProxyClientPoolFromString(t *testing.T) {
 		t.Fatalf("expected nil pool for empty list")
 	}
 }
+
+func TestClientMethodsHonorHTTPVersion(t *testing.T) {
+	cases := []struct {
+		version HTTPVersion
+		proto   string
+	}{
+		{HTTP1, "HTTP/1.1"},
+		{HTTP2, "HTTP/2.0"},
+		{HTTP3, "HTTP/3.0"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.proto, func(t *testing.T) {
+			base, c := newTestServerForVersion(t, tc.version, protoEchoHandler())
+			defer c.CloseIdleConnections()
+
+			status, body, err := c.Get(nil, base+"/")
+			if err != nil || status != fasthttp.StatusOK || string(body) != tc.proto {
+				t.Fatalf("Get: status=%d body=%q err=%v", status, body, err)
+			}
+
+			dst := []byte("stale")
+			_, body, err = c.GetTimeout(dst, base+"/redirect", 5*time.Second)
+			if err != nil || string(body) != tc.proto {
+				t.Fatalf("GetTimeout: body=%q err=%v", body, err)
+			}
+
+			_, body, err = c.GetDeadline(nil, base+"/", time.Now().Add(5*time.Second))
+			if err != nil || string(body) != tc.proto {
+				t.Fatalf("GetDeadline: body=%q err=%v", body, err)
+			}
+
+			args := fasthttp.AcquireArgs()
+			args.Set("foo", "bar")
+			_, body, err = c.Post(nil, base+"/", args)
+			fasthttp.ReleaseArgs(args)
+			if err != nil || string(body) != tc.proto+" foo=bar" {
+				t.Fatalf("Post: body=%q err=%v", body, err)
+			}
+
+			var req Request
+			var resp Response
+			req.SetRequestURI(base + "/redirect")
+			if err := c.Do(&req, &resp); err != nil || resp.StatusCode() != fasthttp.StatusFound {
+				t.Fatalf("Do should not follow redirects: status=%d err=%v", resp.StatusCode(), err)
+			}
+
+			req.SetRequestURI(base + "/redirect")
+			if err := c.DoRedirects(&req, &resp, 2); err != nil {
+				t.Fatalf("DoRedirects: %v", err)
+			}
+			if got := string(resp.Header.Peek("X-Path")); got != "/final" {
+				t.Fatalf("DoRedirects ended at %q, want /final", got)
+			}
+			if got := string(resp.Header.Peek("X-Proto")); got != tc.proto {
+				t.Fatalf("DoRedirects used %q, want %q", got, tc.proto)
+			}
+
+			req.SetRequestURI(base + "/loop")
+			if err := c.DoRedirects(&req, &resp, 2); err != fasthttp.ErrTooManyRedirects {
+				t.Fatalf("expected ErrTooManyRedirects, got %v", err)
+			}
+
+			req.SetRequestURI(base + "/")
+			if err := c.DoDeadline(&req, &resp, time.Now().Add(5*time.Second)); err != nil {
+				t.Fatalf("DoDeadline: %v", err)
+			}
+			if string(resp.Body()) != tc.proto {
+				t.Fatalf("DoDeadline used %q, want %q", resp.Body(), tc.proto)
+			}
+
+			req.SetRequestURI(base + "/slow")
+			if err := c.DoTimeout(&req, &resp, 100*time.Millisecond); err != fasthttp.ErrTimeout {
+				t.Fatalf("expected ErrTimeout from DoTimeout, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDoCtxCancelsEveryHTTPVersion(t *testing.T) {
+	for _, version := range []HTTPVersion{HTTP1, HTTP2, HTTP3} {
+		t.Run(fmt.Sprintf("HTTP%d", version), func(t *testing.T) {
+			base, c := newTestServerForVersion(t, version, protoEchoHandler())
+			defer c.CloseIdleConnections()
+
+			body, status, err := c.DoBytesCtx(context.Background(), fasthttp.MethodGet, base+"/", nil)
+			if err != nil || status != fasthttp.StatusOK || len(body) == 0 {
+				t.Fatalf("DoBytesCtx: status=%d body=%q err=%v", status, body, err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			var req Request
+			var resp Response
+			req.SetRequestURI(base + "/slow")
+			start := time.Now()
+			err = c.DoCtx(ctx, &req, &resp)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected error wrapping context.Canceled, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("DoCtx returned after %s, expected prompt cancellation", elapsed)
+			}
+
+			ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, _, err = c.PostJSONCtx(ctx, base+"/slow", map[string]string{"a": "b"})
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected error wrapping context.DeadlineExceeded, got %v", err)
+			}
+
+			body, _, err = c.DoBytesCtx(context.Background(), fasthttp.MethodGet, base+"/", nil)
+			if err != nil || len(body) == 0 {
+				t.Fatalf("client unusable after cancellation: body=%q err=%v", body, err)
+			}
+		})
+	}
+}
+
+func TestDoCtxHTTP1ReusesConnections(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(protoEchoHandler())
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := NewClientWithOptions(ClientOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		body, _, err := c.DoBytesCtx(ctx, fasthttp.MethodGet, srv.URL+"/", nil)
+		if err != nil || string(body) != "HTTP/1.1" {
+			t.Fatalf("request %d: body=%q err=%v", i, body, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected a single keep-alive connection, got %d", n)
+	}
+}
+
+// TestDoCtxHTTP1ClosesIdleConnections checks that idle connections are
+// closed after MaxIdleConnDuration without another request to the host.
+func TestDoCtxHTTP1ClosesIdleConnections(t *testing.T) {
+	var closed atomic.Int32
+	srv := httptest.NewUnstartedServer(protoEchoHandler())
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := NewClientWithOptions(ClientOptions{MaxIdleConnDuration: 50 * time.Millisecond})
+	if _, _, err := c.DoBytesCtx(context.Background(), fasthttp.MethodGet, srv.URL+"/", nil); err != nil {
+		t.Fatalf("DoBytesCtx: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for closed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the idle connection wasn't closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDoCtxHTTP1ResendsOnlyUnsentPOST checks that a POST on a reused
+// connection is sent again when the server had closed the connection, but
+// not after a read timeout, when the server may be acting on it.
+func TestDoCtxHTTP1ResendsOnlyUnsentPOST(t *testing.T) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if posts.Add(1) > 1 {
+				time.Sleep(300 * time.Millisecond)
+			}
+		}
+	}))
+	defer srv.Close()
+	c := NewClientWithOptions(ClientOptions{ReadTimeout: 100 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, _, err := c.DoBytesCtx(ctx, fasthttp.MethodGet, srv.URL+"/", nil); err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	srv.CloseClientConnections()
+	if _, _, err := c.DoBytesCtx(ctx, fasthttp.MethodPost, srv.URL+"/", nil); err != nil {
+		t.Fatalf("POST on a connection the server closed: %v", err)
+	}
+	if _, _, err := c.DoBytesCtx(ctx, fasthttp.MethodPost, srv.URL+"/", nil); !isTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if n := posts.Load(); n != 2 {
+		t.Fatalf("expected the server to get 2 POSTs, got %d", n)
+	}
+}
+
+func TestDoCtxAbortsProxyConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Accept the CONNECT but never answer it.
+			defer conn.Close()
+		}
+	}()
+
+	for _, version := range []HTTPVersion{HTTP1, HTTP2} {
+		c := NewClientWithOptions(ClientOptions{HTTPVersion: version, ProxyHTTP: ln.Addr().String()})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		var req Request
+		var resp Response
+		req.SetRequestURI("https://example.com/")
+		start := time.Now()
+		err := c.DoCtx(ctx, &req, &resp)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("HTTP%d: expected error wrapping context.DeadlineExceeded, got %v", version, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("HTTP%d: proxy CONNECT not aborted, took %s", version, elapsed)
+		}
+	}
+}
+
+func TestClientPoolDoCtx(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+
+	pool := NewClientPool(2, func() *Client { return NewClientWithOptions(ClientOptions{}) })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	if err := pool.DoCtx(ctx, &req, &resp); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled for a cancelled context, got %v", err)
+	}
+	if err := pool.DoCtx(context.Background(), &req, &resp); err != nil || string(resp.Body()) != "HTTP/1.1" {
+		t.Fatalf("pool.DoCtx: body=%q err=%v", resp.Body(), err)
+	}
+}
+
+func TestRequestHeaderOrderAndCasing(t *testing.T) {
+	tests := []struct {
+		name   string
+		opt    ClientOptions
+		server func(testing.TB) (string, <-chan []string)
+		sorted bool
+		want   []string
+	}{
+		{"HTTP1", ClientOptions{HTTPVersion: HTTP1}, newTestRawHTTP1Server, false,
+			[]string{"X-Zeta: 1", "x-alpha: 2", "X-MiXed: 3"}},
+		{"HTTP2NativeOverHTTP1", ClientOptions{HTTPVersion: HTTP2}, newTestRawHTTP1Server, false,
+			[]string{"X-Zeta: 1", "x-alpha: 2", "X-MiXed: 3"}},
+		// net/http writes HTTP/1.1 headers sorted by name.
+		{"HTTP2NetHTTPOverHTTP1", ClientOptions{HTTPVersion: HTTP2, DisableNativeHTTP2: true}, newTestRawHTTP1Server, false,
+			[]string{"X-MiXed: 3", "X-Zeta: 1", "x-alpha: 2"}},
+		{"H2C", ClientOptions{HTTPVersion: HTTP2, H2C: true}, newTestRawH2CServer, false,
+			[]string{"x-zeta: 1", "x-alpha: 2", "x-mixed: 3"}},
+		// net/http sends HTTP/2 and HTTP/3 headers in map order.
+		{"H2CNetHTTP", ClientOptions{HTTPVersion: HTTP2, H2C: true, DisableNativeHTTP2: true}, newTestRawH2CServer, true,
+			[]string{"x-alpha: 2", "x-mixed: 3", "x-zeta: 1"}},
+		{"HTTP3", ClientOptions{HTTPVersion: HTTP3, TLSConfig: testClientTLSConfig()}, newTestRawH3Server, true,
+			[]string{"x-alpha: 2", "x-mixed: 3", "x-zeta: 1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, requests := tt.server(t)
+			opt := tt.opt
+			opt.DisableHeaderNamesNormalizing = true
+			c := NewClientWithOptions(opt)
+			defer c.CloseIdleConnections()
+
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			req.Header.DisableNormalizing()
+			req.SetRequestURI(base)
+			req.Header.Set("X-Zeta", "1")
+			req.Header.Set("x-alpha", "2")
+			req.Header.Set("X-MiXed", "3")
+			if err := c.Do(req, resp); err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+
+			var got []string
+			for _, line := range <-requests {
+				if strings.HasPrefix(strings.ToLower(line), "x-") {
+					got = append(got, line)
+				}
+			}
+			if tt.sorted {
+				sort.Strings(got)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("headers on the wire:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package v2fasthttp
 
 import (
+	"crypto/tls"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -114,3 +115,66 @@ func BenchmarkFastHTTP_Client_Do(b *testing.B) {
 		resp.ResetBody()
 	}
 }
+
+var (
+	benchH2ServerOnce sync.Once
+	benchH2ServerURL  string
+)
+
+func getBenchH2ServerURL(b *testing.B) string {
+	cert := testCertificate(b)
+	benchH2ServerOnce.Do(func() {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("OK"))
+		}))
+		srv.EnableHTTP2 = true
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv.StartTLS()
+		benchH2ServerURL = srv.URL
+	})
+	return benchH2ServerURL
+}
+
+func benchmarkH2Client(b *testing.B, c *Client) {
+	url := getBenchH2ServerURL(b)
+	defer c.CloseIdleConnections()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var req Request
+		var resp Response
+		req.SetRequestURI(url)
+		req.Header.SetMethod("GET")
+		for pb.Next() {
+			if err := c.Do(&req, &resp); err != nil {
+				b.Fatal(err)
+			}
+			resp.ResetBody()
+		}
+	})
+}
+
+func BenchmarkV2FastHTTP_HTTP2_Native(b *testing.B) {
+	benchmarkH2Client(b, NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP2,
+		TLSConfig:   testClientTLSConfig(),
+	}))
+}
+
+func BenchmarkV2FastHTTP_HTTP2_NetHTTP(b *testing.B) {
+	benchmarkH2Client(b, NewClientWithOptions(ClientOptions{
+		HTTPVersion:        HTTP2,
+		TLSConfig:          testClientTLSConfig(),
+		DisableNativeHTTP2: true,
+	}))
+}
+
+func BenchmarkV2FastHTTP_HTTP1_TLS(b *testing.B) {
+	benchmarkH2Client(b, NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP1,
+		TLSConfig:   testClientTLSConfig(),
+	}))
+}
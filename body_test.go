@@ -0,0 +1,289 @@
+package v2fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// gatedReader yields first, then waits for gate before yielding rest: a
+// client that buffers the whole body before sending never gets past first.
+type gatedReader struct {
+	first, rest []byte
+	gate        chan struct{}
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	if len(r.first) > 0 {
+		n := copy(p, r.first)
+		r.first = r.first[n:]
+		return n, nil
+	}
+	if r.gate != nil {
+		select {
+		case <-r.gate:
+		case <-time.After(5 * time.Second):
+			return 0, fmt.Errorf("body was not streamed")
+		}
+		r.gate = nil
+	}
+	if len(r.rest) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// streamEchoHandler reports the request's protocol, Content-Length and body
+// size, and closes gate once the first byte of the body has arrived.
+func streamEchoHandler(gate chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var first [1]byte
+		if _, err := io.ReadFull(r.Body, first[:]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		close(gate)
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s %d %d", r.Proto, r.ContentLength, n+1)
+	})
+}
+
+// bodyTests are the transports that don't go through fasthttp.
+var bodyTests = []struct {
+	name    string
+	version HTTPVersion
+	opt     ClientOptions
+	proto   string
+}{
+	{"HTTP2", HTTP2, ClientOptions{}, "HTTP/2.0"},
+	{"HTTP2NetHTTP", HTTP2, ClientOptions{DisableNativeHTTP2: true}, "HTTP/2.0"},
+	{"HTTP3", HTTP3, ClientOptions{}, "HTTP/3.0"},
+}
+
+func newBodyTestClient(version HTTPVersion, opt ClientOptions) *Client {
+	opt.HTTPVersion = version
+	opt.TLSConfig = testClientTLSConfig()
+	return NewClientWithOptions(opt)
+}
+
+func TestStreamingRequestBody(t *testing.T) {
+	const size = 4 << 20
+	for _, tt := range bodyTests {
+		for _, length := range []int{size, -1} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, length), func(t *testing.T) {
+				gate := make(chan struct{})
+				base, _ := newTestServerForVersion(t, tt.version, streamEchoHandler(gate))
+				c := newBodyTestClient(tt.version, tt.opt)
+				defer c.CloseIdleConnections()
+
+				req := fasthttp.AcquireRequest()
+				resp := fasthttp.AcquireResponse()
+				defer fasthttp.ReleaseRequest(req)
+				defer fasthttp.ReleaseResponse(resp)
+				req.SetRequestURI(base)
+				req.Header.SetMethod(fasthttp.MethodPut)
+				req.SetBodyStream(&gatedReader{
+					first: bytes.Repeat([]byte("a"), 64<<10),
+					rest:  bytes.Repeat([]byte("b"), size-64<<10),
+					gate:  gate,
+				}, length)
+
+				if err := c.Do(req, resp); err != nil {
+					t.Fatalf("Do: %v", err)
+				}
+				want := fmt.Sprintf("%s %d %d", tt.proto, length, size)
+				if string(resp.Body()) != want {
+					t.Fatalf("body %q, want %q", resp.Body(), want)
+				}
+			})
+		}
+	}
+}
+
+func TestStreamingRequestBodyWriter(t *testing.T) {
+	gate := make(chan struct{})
+	srv := newTestH2Server(t, streamEchoHandler(gate))
+	c := newNativeH2Client(ClientOptions{})
+	defer c.CloseIdleConnections()
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(srv.URL)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetBodyStreamWriter(func(w *bufio.Writer) {
+		_, _ = w.WriteString("hello ")
+		_ = w.Flush()
+		<-gate
+		_, _ = w.WriteString("world")
+	})
+
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if got := string(resp.Body()); got != "HTTP/2.0 -1 11" {
+		t.Fatalf("body %q", got)
+	}
+}
+
+// bigBodyHandler sends size bytes, with a Content-Length unless unknown is
+// set. The rest of the body after the first flush waits for gate.
+func bigBodyHandler(size int, gate chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("unknown") == "" {
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+		}
+		chunk := bytes.Repeat([]byte("x"), 32<<10)
+		_, _ = w.Write(chunk)
+		w.(http.Flusher).Flush()
+		if gate != nil {
+			select {
+			case <-gate:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+		for sent := len(chunk); sent < size; sent += len(chunk) {
+			if _, err := w.Write(chunk[:min(len(chunk), size-sent)]); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestMaxResponseBodySize(t *testing.T) {
+	for _, tt := range bodyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, _ := newTestServerForVersion(t, tt.version, bigBodyHandler(1<<20, nil))
+			c := newBodyTestClient(tt.version, ClientOptions{MaxResponseBodySize: 64 << 10})
+			defer c.CloseIdleConnections()
+
+			for _, url := range []string{base, base + "/?unknown=1"} {
+				if _, _, err := c.GetBytes(url); !errors.Is(err, fasthttp.ErrBodyTooLarge) {
+					t.Fatalf("%s: expected ErrBodyTooLarge, got %v", url, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamResponseBody(t *testing.T) {
+	// Bigger than the stream flow-control window of the native transport.
+	const size = 10 << 20
+	for _, tt := range bodyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate := make(chan struct{})
+			base, _ := newTestServerForVersion(t, tt.version, bigBodyHandler(size, gate))
+			c := newBodyTestClient(tt.version, ClientOptions{MaxResponseBodySize: 64 << 10})
+			c.StreamResponseBody = true
+			defer c.CloseIdleConnections()
+
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			req.SetRequestURI(base + "/?unknown=1")
+
+			// The server holds back most of the body until gate is closed,
+			// so Do must return before the body is complete.
+			if err := c.Do(req, resp); err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			if !resp.IsBodyStream() {
+				t.Fatalf("expected a body stream")
+			}
+			close(gate)
+			n, err := io.Copy(io.Discard, resp.BodyStream())
+			if err != nil || n != size {
+				t.Fatalf("read %d bytes, err %v; want %d", n, err, size)
+			}
+
+			// Closing a stream early leaves the client usable.
+			req.SetRequestURI(base)
+			resp.Reset()
+			if err := c.Do(req, resp); err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			if err := resp.CloseBodyStream(); err != nil {
+				t.Fatalf("CloseBodyStream: %v", err)
+			}
+			body, _, err := c.GetBytes(base)
+			if err != nil || len(body) != size {
+				t.Fatalf("GetBytes after an early close: %d bytes, %v", len(body), err)
+			}
+		})
+	}
+}
+
+func trailerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+	})
+}
+
+func TestResponseMetadata(t *testing.T) {
+	tests := append([]struct {
+		name    string
+		version HTTPVersion
+		opt     ClientOptions
+		proto   string
+	}{{"HTTP1", HTTP1, ClientOptions{}, "HTTP/1.1"}}, bodyTests...)
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			if stream && tt.version == HTTP1 {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s/stream=%v", tt.name, stream), func(t *testing.T) {
+				base, _ := newTestServerForVersion(t, tt.version, trailerHandler())
+				c := newBodyTestClient(tt.version, tt.opt)
+				defer c.CloseIdleConnections()
+
+				req := fasthttp.AcquireRequest()
+				resp := fasthttp.AcquireResponse()
+				defer fasthttp.ReleaseRequest(req)
+				defer fasthttp.ReleaseResponse(resp)
+				req.SetRequestURI(base)
+				resp.StreamBody = stream
+
+				var info RequestInfo
+				if err := c.DoCtx(WithRequestInfo(context.Background(), &info), req, resp); err != nil {
+					t.Fatalf("DoCtx: %v", err)
+				}
+				body, err := responseBody(resp)
+				if err != nil || string(body) != "body" {
+					t.Fatalf("body %q, err %v", body, err)
+				}
+				if got := string(resp.Header.Protocol()); got != tt.proto {
+					t.Fatalf("Protocol() = %q, want %q", got, tt.proto)
+				}
+				if got := string(resp.Header.Peek("X-Checksum")); got != "abc" {
+					t.Fatalf("X-Checksum trailer = %q", got)
+				}
+				if got := string(resp.Header.Peek("X-Late")); got != "late" {
+					t.Fatalf("X-Late trailer = %q", got)
+				}
+				if info.Protocol != tt.proto || info.TLS == nil || !info.TLS.HandshakeComplete {
+					t.Fatalf("info %+v", info)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package v2fasthttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http/httpproxy"
+	xnetproxy "golang.org/x/net/proxy"
+)
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+const defaultDialTimeout = 3 * time.Second
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: defaultDialTimeout}
+	return d.DialContext(ctx, network, addr)
+}
+
+// dialFasthttp is fasthttp's dialer. fasthttp copies Dial into its
+// per-host clients, so it has to look up the current dialer on every dial
+// for proxy changes to apply to known hosts.
+func (c *Client) dialFasthttp(addr string) (net.Conn, error) {
+	if dial := c.current().dial; dial != nil {
+		return dial(context.Background(), "tcp", addr)
+	}
+	if c.DialDualStack {
+		return fasthttp.DialDualStack(addr)
+	}
+	return fasthttp.Dial(addr)
+}
+
+func (c *Client) dialer() dialContextFunc {
+	if dial := c.current().dial; dial != nil {
+		return dial
+	}
+	if c.Client.Dial != nil && !c.fasthttpDial.Load() {
+		dial := c.Client.Dial
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialWithContext(ctx, func() (net.Conn, error) { return dial(addr) })
+		}
+	}
+	return dialDirect
+}
+
+// connectsDirectly reports whether connections go straight to the target,
+// without a proxy or a custom fasthttp dialer.
+func (c *Client) connectsDirectly() bool {
+	return c.current().dial == nil && (c.Client.Dial == nil || c.fasthttpDial.Load())
+}
+
+// dialWithContext runs a dial that has no context support and abandons it
+// when ctx is done, closing the connection if it shows up afterwards.
+func dialWithContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialTLS dials addr with dial and, if tlsConfig is not nil, performs the
+// TLS handshake bound to ctx.
+func dialTLS(ctx context.Context, dial dialContextFunc, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Like fasthttp, a dialer that already returns TLS connections is trusted
+	// to have done the handshake.
+	if _, isTLS := conn.(interface{ Handshake() error }); isTLS || tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func clientTLSConfig(cfg *tls.Config, addr string, nextProtos ...string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg.ServerName = host
+	}
+	if len(nextProtos) > 0 {
+		cfg.NextProtos = nextProtos
+	}
+	return cfg
+}
+
+// watchConn aborts any pending I/O on conn once ctx is done. The returned
+// function reports whether conn is still usable.
+func watchConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return true }
+	}
+	return context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(aLongTimeAgo)
+	})
+}
+
+// ctxError makes sure an error caused by ctx being done wraps ctx.Err().
+func ctxError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	ctxErr := ctxDone(ctx)
+	if ctxErr == nil || errors.Is(err, ctxErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctxErr, err)
+}
+
+// ctxDone is ctx.Err(), counting ctx as expired from its deadline on: a
+// connection deadline taken from ctx can fire before ctx's own timer.
+func ctxDone(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func httpProxyDialer(p ProxySpec, forward dialContextFunc, tlsConfig *tls.Config) dialContextFunc {
+	var auth string
+	if p.Username != "" || p.Password != "" {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
+	}
+	var proxyTLS *tls.Config
+	if p.Scheme == "https" {
+		proxyTLS = p.proxyTLSConfig(tlsConfig)
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, "tcp", p.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyTLS != nil {
+			tlsConn := tls.Client(conn, proxyTLS)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			// Hide the TLS methods: the dialers that see them take the
+			// connection as already secured to the target.
+			conn = proxyTLSConn{tlsConn}
+		}
+		stop := watchConn(ctx, conn)
+		tunnel, err := httpConnect(conn, addr, auth)
+		if !stop() {
+			conn.Close()
+			return nil, ctxError(ctx, err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	}
+}
+
+func httpConnect(conn net.Conn, addr, auth string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+	res.SkipBody = true
+	br := bufio.NewReader(conn)
+	if err := res.Read(br); err != nil {
+		return nil, err
+	}
+	if res.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("could not connect to proxy: status code: %d", res.StatusCode())
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type proxyTLSConn struct {
+	net.Conn
+}
+
+// bufferedConn hands out bytes the proxy sent right after its response head
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func socks5ProxyDialer(p ProxySpec, forward dialContextFunc) (dialContextFunc, error) {
+	d, err := xnetproxy.FromURL(p.URL(), forwardDialer(forward))
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(xnetproxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy %s does not support contexts", p)
+	}
+	if p.Scheme == "socks5h" {
+		return cd.DialContext, nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addr, err := resolveAddr(ctx, "ip", addr)
+		if err != nil {
+			return nil, err
+		}
+		return cd.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// resolveAddr replaces the host name in addr with one of its IP addresses.
+func resolveAddr(ctx context.Context, network, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return "", err
+	}
+	// Prefer IPv4, which every proxy can reach.
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.To4() != nil {
+			ip = candidate
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+func socks4ProxyDialer(p ProxySpec, forward dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if p.Scheme == "socks4" {
+			var err error
+			if addr, err = resolveAddr(ctx, "ip4", addr); err != nil {
+				return nil, err
+			}
+		}
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("socks4: invalid port in %q", addr)
+		}
+		// SOCKS4a: an IP of 0.0.0.x asks the proxy to resolve the name
+		// sent after the user ID.
+		req := binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(port))
+		ip := net.ParseIP(host)
+		if ip != nil {
+			if ip = ip.To4(); ip == nil {
+				return nil, fmt.Errorf("socks4: %s is not an IPv4 address", host)
+			}
+			req = append(req, ip...)
+		} else {
+			req = append(req, 0, 0, 0, 1)
+		}
+		req = append(append(req, p.Username...), 0)
+		if ip == nil {
+			req = append(append(req, host...), 0)
+		}
+
+		conn, err := forward(ctx, "tcp", p.Addr)
+		if err != nil {
+			return nil, err
+		}
+		stop := watchConn(ctx, conn)
+		err = socks4Connect(conn, req)
+		if !stop() {
+			conn.Close()
+			return nil, ctxError(ctx, err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func socks4Connect(conn net.Conn, req []byte) error {
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [8]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	switch reply[1] {
+	case 90:
+		return nil
+	case 92, 93:
+		return errors.New("socks4: proxy could not confirm the user ID")
+	default:
+		return fmt.Errorf("socks4: request rejected (reply code %d)", reply[1])
+	}
+}
+
+type forwardDialer dialContextFunc
+
+func (f forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// envProxyDialer mirrors fasthttpproxy.FasthttpProxyHTTPDialer: the target
+// scheme is guessed from the port and HTTP(S)_PROXY/NO_PROXY decide the hop.
+func envProxyDialer(timeout time.Duration) dialContextFunc {
+	proxyFunc := httpproxy.FromEnvironment().ProxyFunc()
+	forward := dialContextFunc(dialDirect)
+	if timeout > 0 {
+		forward = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		scheme := "http"
+		if strings.HasSuffix(addr, ":443") {
+			scheme = "https"
+		}
+		proxyURL, err := proxyFunc(&url.URL{Scheme: scheme, Host: addr})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			return forward(ctx, network, addr)
+		}
+		p, err := ParseProxy(proxyURL.String())
+		if err != nil {
+			return nil, err
+		}
+		dial, err := p.dialer(forward, nil)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, network, addr)
+	}
+}
@@ -10,7 +10,9 @@ func main() {
 	c := v2.NewHighPerfClient("")
 
 	// HTTP proxy, بدون user/pass في المثال
-	c.SetProxyHTTP("127.0.0.1:8080")
+	if err := c.SetProxyHTTP("127.0.0.1:8080"); err != nil {
+		log.Fatal(err)
+	}
 
 	body, status, err := c.GetBytes("https://httpbin.org/ip")
 	if err != nil {
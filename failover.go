@@ -0,0 +1,141 @@
+package v2fasthttp
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// FailoverPolicy makes a ClientPool retry failed requests on other clients.
+// Requests with a body stream and requests made through a Session aren't
+// retried.
+type FailoverPolicy struct {
+	// MaxAttempts caps the attempts of a request, the first one included.
+	// Defaults to 3.
+	MaxAttempts int
+	// RetryStatuses are the response statuses retried on another client,
+	// e.g. 407, 429, 502 and 503. The response of the last attempt is
+	// returned as is.
+	RetryStatuses []int
+	// RetryError decides which errors are retried. By default every error
+	// is but the cancellation of the request's context and
+	// fasthttp.ErrBodyTooLarge.
+	RetryError func(err error) bool
+	// RetryNonIdempotent retries the requests whose method isn't
+	// idempotent, such as POST, too.
+	RetryNonIdempotent bool
+	// OnAttempt, if set, is called after each attempt.
+	OnAttempt func(PoolAttempt)
+}
+
+// PoolAttempt is an attempt of a request made through a ClientPool with a
+// FailoverPolicy.
+type PoolAttempt struct {
+	Client *Client
+	// Proxy is the client's proxy (password redacted), or "" if it has none.
+	Proxy string
+	// Status is the response status, or 0 if Err is set.
+	Status   int
+	Err      error
+	Duration time.Duration
+	// Retried is true when another attempt followed.
+	Retried bool
+}
+
+// SetFailover sets the failover policy of the pool; nil disables failover.
+func (p *ClientPool) SetFailover(policy *FailoverPolicy) {
+	if p == nil {
+		return
+	}
+	if policy != nil {
+		f := *policy
+		if f.MaxAttempts <= 0 {
+			f.MaxAttempts = 3
+		}
+		f.RetryStatuses = slices.Clone(f.RetryStatuses)
+		policy = &f
+	}
+	p.failover.Store(policy)
+}
+
+func (f *FailoverPolicy) retries(req *Request) bool {
+	if f == nil || f.MaxAttempts < 2 || req.IsBodyStream() {
+		return false
+	}
+	return f.RetryNonIdempotent || isIdempotent(string(req.Header.Method()))
+}
+
+func (f *FailoverPolicy) shouldRetry(err error, resp *Response) bool {
+	switch {
+	case err == nil:
+		return slices.Contains(f.RetryStatuses, resp.StatusCode())
+	case f.RetryError != nil:
+		return f.RetryError(err)
+	}
+	return isClientFailure(err)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case fasthttp.MethodGet, fasthttp.MethodHead, fasthttp.MethodOptions,
+		fasthttp.MethodTrace, fasthttp.MethodPut, fasthttp.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// doFailover makes the request through m, then through other members for
+// as long as the policy retries it.
+func (p *ClientPool) doFailover(ctx context.Context, f *FailoverPolicy, m *PoolMember, req *Request, resp *Response, do func(*Client) error) error {
+	info := requestInfoFromContext(ctx)
+	tried := make([]*PoolMember, 0, f.MaxAttempts)
+	for {
+		start := time.Now()
+		err := p.doMember(ctx, m, resp, do)
+		tried = append(tried, m)
+		var next *PoolMember
+		if len(tried) < f.MaxAttempts && ctx.Err() == nil && f.shouldRetry(err, resp) {
+			next = p.nextExcluding(req, tried)
+		}
+
+		a := PoolAttempt{
+			Client:   m.client,
+			Proxy:    clientProxyName(m.client),
+			Err:      err,
+			Duration: time.Since(start),
+			Retried:  next != nil,
+		}
+		if err == nil {
+			a.Status = resp.StatusCode()
+		}
+		if info != nil {
+			info.Attempts = append(info.Attempts, a)
+		}
+		if f.OnAttempt != nil {
+			f.OnAttempt(a)
+		}
+		if next == nil {
+			return err
+		}
+		m = next
+	}
+}
+
+// nextExcluding picks among the healthy members not in tried.
+func (p *ClientPool) nextExcluding(req *Request, tried []*PoolMember) *PoolMember {
+	if p.closed.Load() {
+		return nil
+	}
+	var rest []*PoolMember
+	for _, m := range *p.healthy.Load() {
+		if !slices.Contains(tried, m) {
+			rest = append(rest, m)
+		}
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	return p.selector.Select(req, rest)
+}
@@ -0,0 +1,128 @@
+package v2fasthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newTestFailoverPool(t *testing.T, n int, policy *FailoverPolicy) (*ClientPool, []*testHTTPProxy) {
+	t.Helper()
+	proxies := make([]*testHTTPProxy, n)
+	clients := make([]*Client, n)
+	for i := range proxies {
+		proxies[i] = newTestHTTPProxy(t, false, "")
+		clients[i] = NewHighPerfClient(proxies[i].URL(""))
+	}
+	pool := NewClientPoolWithOptions(ClientPoolOptions{Clients: clients, Failover: policy})
+	t.Cleanup(pool.Close)
+	return pool, proxies
+}
+
+func TestClientPoolFailoverOnError(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	var attempts atomic.Int32
+	pool, proxies := newTestFailoverPool(t, 2, &FailoverPolicy{
+		OnAttempt: func(PoolAttempt) { attempts.Add(1) },
+	})
+	proxies[0].down.Store(true)
+
+	reported, retried := 0, 0
+	for i := 0; i < 4; i++ {
+		var info RequestInfo
+		var req Request
+		var resp Response
+		req.SetRequestURI(srv.URL + "/")
+		if err := pool.DoCtx(WithRequestInfo(context.Background(), &info), &req, &resp); err != nil {
+			t.Fatalf("DoCtx: %v", err)
+		}
+		last := info.Attempts[len(info.Attempts)-1]
+		if last.Proxy != proxies[1].URL("") || last.Status != fasthttp.StatusOK || last.Retried {
+			t.Fatalf("unexpected last attempt: %+v", last)
+		}
+		if len(info.Attempts) == 2 && (info.Attempts[0].Err == nil || !info.Attempts[0].Retried) {
+			t.Fatalf("unexpected first attempt: %+v", info.Attempts[0])
+		}
+		reported += len(info.Attempts)
+		retried += len(info.Attempts) - 1
+	}
+	if n := attempts.Load(); int(n) != reported || retried == 0 {
+		t.Fatalf("OnAttempt saw %d attempts, RequestInfo %d with %d retries", n, reported, retried)
+	}
+
+	// POST isn't retried unless asked for.
+	failures := 0
+	for i := 0; i < 2; i++ {
+		var req Request
+		var resp Response
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.SetRequestURI(srv.URL + "/")
+		if err := pool.Do(&req, &resp); err != nil {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Fatalf("expected 1 of 2 POSTs to fail, got %d", failures)
+	}
+	pool.SetFailover(&FailoverPolicy{RetryNonIdempotent: true})
+	for i := 0; i < 2; i++ {
+		var req Request
+		var resp Response
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.SetRequestURI(srv.URL + "/")
+		if err := pool.Do(&req, &resp); err != nil {
+			t.Fatalf("retried POST: %v", err)
+		}
+	}
+}
+
+func TestClientPoolFailoverOnStatus(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	pool, _ := newTestFailoverPool(t, 2, &FailoverPolicy{RetryStatuses: []int{429, 502, 503}})
+
+	var info RequestInfo
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	if err := pool.DoCtx(WithRequestInfo(context.Background(), &info), &req, &resp); err != nil {
+		t.Fatalf("DoCtx: %v", err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK || len(info.Attempts) != 2 {
+		t.Fatalf("status %d after %d attempts", resp.StatusCode(), len(info.Attempts))
+	}
+	first, second := info.Attempts[0], info.Attempts[1]
+	if first.Status != fasthttp.StatusServiceUnavailable || !first.Retried || first.Proxy == second.Proxy {
+		t.Fatalf("unexpected attempts: %+v", info.Attempts)
+	}
+}
+
+func TestClientPoolFailoverMaxAttempts(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	pool, proxies := newTestFailoverPool(t, 3, &FailoverPolicy{MaxAttempts: 2})
+	for _, p := range proxies {
+		p.down.Store(true)
+	}
+
+	var info RequestInfo
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	if err := pool.DoCtx(WithRequestInfo(context.Background(), &info), &req, &resp); err == nil {
+		t.Fatalf("expected an error with every proxy down")
+	}
+	if len(info.Attempts) != 2 || info.Attempts[1].Retried || info.Attempts[0].Proxy == info.Attempts[1].Proxy {
+		t.Fatalf("unexpected attempts: %+v", info.Attempts)
+	}
+}
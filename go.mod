@@ -3,6 +3,8 @@ module github.com/seiffpes/v2fasthttp
 go 1.25.3
 
 require (
+	github.com/dop251/goja v0.0.0-20260106131823-651366fbe6e3
+	github.com/quic-go/qpack v0.6.0
 	github.com/quic-go/quic-go v0.57.1
 	github.com/valyala/fasthttp v1.51.0
 	golang.org/x/net v0.43.0
@@ -10,8 +12,10 @@ require (
 
 require (
 	github.com/andybalholm/brotli v1.0.5 // indirect
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/klauspost/compress v1.17.0 // indirect
-	github.com/quic-go/qpack v0.6.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
@@ -0,0 +1,312 @@
+package v2fasthttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fasthttp has no way to interrupt a request that is already in flight, so
+// context-bound HTTP/1.1 requests run over their own connections where every
+// step (dial, proxy handshake, TLS, write, read) is tied to the context.
+
+type h1Conn struct {
+	net.Conn
+	br       *bufio.Reader
+	bw       *bufio.Writer
+	created  time.Time
+	lastUsed time.Time
+}
+
+type h1ConnPool struct {
+	mu       sync.Mutex
+	idle     map[string][]*h1Conn
+	cleaning bool
+}
+
+func (p *h1ConnPool) get(key string, maxIdle time.Duration) *h1Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		cc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(cc.lastUsed) < maxIdle {
+			p.idle[key] = conns
+			return cc
+		}
+		cc.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+func (p *h1ConnPool) put(key string, cc *h1Conn, maxConns int, maxIdle time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[key]) >= maxConns {
+		return false
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*h1Conn)
+	}
+	cc.lastUsed = time.Now()
+	p.idle[key] = append(p.idle[key], cc)
+	if !p.cleaning {
+		p.cleaning = true
+		go p.clean(maxIdle)
+	}
+	return true
+}
+
+// clean closes the connections left idle for maxIdle, like fasthttp's
+// connection cleaner, until the pool is empty.
+func (p *h1ConnPool) clean(maxIdle time.Duration) {
+	for {
+		time.Sleep(maxIdle)
+
+		p.mu.Lock()
+		var expired []*h1Conn
+		for key, conns := range p.idle {
+			kept := conns[:0]
+			for _, cc := range conns {
+				if time.Since(cc.lastUsed) < maxIdle {
+					kept = append(kept, cc)
+				} else {
+					expired = append(expired, cc)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		done := len(p.idle) == 0
+		if done {
+			p.cleaning = false
+		}
+		p.mu.Unlock()
+
+		for _, cc := range expired {
+			cc.Close()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// closeIdle closes the idle connections whose key starts with prefix.
+func (p *h1ConnPool) closeIdle(prefix string) {
+	p.mu.Lock()
+	var idle []*h1Conn
+	for key, conns := range p.idle {
+		if strings.HasPrefix(key, prefix) {
+			idle = append(idle, conns...)
+			delete(p.idle, key)
+		}
+	}
+	p.mu.Unlock()
+	for _, cc := range idle {
+		cc.Close()
+	}
+}
+
+func (c *Client) doCtxHTTP1(ctx context.Context, req *Request, resp *Response) error {
+	uri := req.URI()
+	var isTLS bool
+	switch string(uri.Scheme()) {
+	case "https":
+		isTLS = true
+	case "http":
+	default:
+		return fmt.Errorf("unsupported protocol %q. http and https are supported", uri.Scheme())
+	}
+	addr := fasthttp.AddMissingPort(string(uri.Host()), isTLS)
+	proxy := requestProxyFromContext(ctx)
+	key := proxyPoolKey(proxy) + string(uri.Scheme()) + "://" + addr
+
+	uri.DisablePathNormalizing = c.DisablePathNormalizing
+	c.setUserAgent(req)
+
+	skipBody := resp.SkipBody
+	for attempt := 0; ; attempt++ {
+		cc, reused, err := c.acquireH1Conn(ctx, key, addr, isTLS, proxy)
+		if err != nil {
+			return ctxError(ctx, err)
+		}
+		resp.Reset()
+		resp.SkipBody = skipBody || req.Header.IsHead()
+		err = c.roundTripH1(ctx, key, cc, req, resp)
+		resp.SkipBody = skipBody
+		if err == nil {
+			setRequestProtocol(ctx, "HTTP/1.1")
+			setRequestTLS(ctx, cc.Conn)
+			return nil
+		}
+		if ctxDone(ctx) != nil {
+			return ctxError(ctx, err)
+		}
+		// A reused keep-alive connection may have been closed by the server
+		// while idle; try once more on a fresh one. Unless the connection
+		// closed before the response began, the server may have acted on
+		// the request, so only idempotent ones are sent again.
+		if !reused || attempt > 0 || req.IsBodyStream() || err == fasthttp.ErrBodyTooLarge || isTimeout(err) {
+			return err
+		}
+		if err != fasthttp.ErrConnectionClosed && !isIdempotent(string(req.Header.Method())) {
+			return err
+		}
+	}
+}
+
+func (c *Client) acquireH1Conn(ctx context.Context, key, addr string, isTLS bool, proxy *ProxySpec) (cc *h1Conn, reused bool, err error) {
+	if cc := c.h1Conns.get(key, c.h1MaxIdle()); cc != nil {
+		return cc, true, nil
+	}
+
+	var tlsConfig *tls.Config
+	if isTLS {
+		tlsConfig = clientTLSConfig(sessionsThrough(c.TLSConfig, proxy), addr)
+	}
+	conn, err := dialTLS(ctx, c.proxyDialer(proxy), addr, tlsConfig)
+	if err != nil {
+		return nil, false, err
+	}
+	return c.newH1Conn(conn), false, nil
+}
+
+func (c *Client) newH1Conn(conn net.Conn) *h1Conn {
+	readBufferSize := c.ReadBufferSize
+	if readBufferSize <= 0 {
+		readBufferSize = 4096
+	}
+	writeBufferSize := c.WriteBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = 4096
+	}
+	now := time.Now()
+	return &h1Conn{
+		Conn:     conn,
+		br:       bufio.NewReaderSize(conn, readBufferSize),
+		bw:       bufio.NewWriterSize(conn, writeBufferSize),
+		created:  now,
+		lastUsed: now,
+	}
+}
+
+func (c *Client) putH1Conn(key string, cc *h1Conn) {
+	maxConns := c.MaxConnsPerHost
+	if maxConns <= 0 {
+		maxConns = fasthttp.DefaultMaxConnsPerHost
+	}
+	if err := cc.SetDeadline(time.Time{}); err != nil || !c.h1Conns.put(key, cc, maxConns, c.h1MaxIdle()) {
+		cc.Close()
+	}
+}
+
+func (c *Client) h1MaxIdle() time.Duration {
+	if c.MaxIdleConnDuration > 0 {
+		return c.MaxIdleConnDuration
+	}
+	return fasthttp.DefaultMaxIdleConnDuration
+}
+
+func (c *Client) setUserAgent(req *Request) {
+	if len(req.Header.UserAgent()) > 0 {
+		return
+	}
+	userAgent := c.Name
+	if userAgent == "" && !c.NoDefaultUserAgentHeader {
+		userAgent = "fasthttp"
+	}
+	if userAgent != "" {
+		req.Header.SetUserAgent(userAgent)
+	}
+}
+
+func (c *Client) roundTripH1(ctx context.Context, key string, cc *h1Conn, req *Request, resp *Response) error {
+	ctxDeadline, _ := ctx.Deadline()
+	stop := watchConn(ctx, cc)
+
+	// Deadlines are set before checking ctx so that a cancellation racing
+	// with SetDeadline is never overwritten.
+	if err := cc.SetWriteDeadline(earliest(ctxDeadline, c.WriteTimeout)); err != nil {
+		stop()
+		cc.Close()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		stop()
+		cc.Close()
+		return err
+	}
+	err := req.Write(cc.bw)
+	if err == nil {
+		err = cc.bw.Flush()
+	}
+	if err != nil {
+		stop()
+		cc.Close()
+		return err
+	}
+
+	if err := cc.SetReadDeadline(earliest(ctxDeadline, c.ReadTimeout)); err != nil {
+		stop()
+		cc.Close()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		stop()
+		cc.Close()
+		return err
+	}
+	if _, err := cc.br.Peek(1); err != nil {
+		stop()
+		cc.Close()
+		if err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+			return fasthttp.ErrConnectionClosed
+		}
+		return err
+	}
+	if c.DisableHeaderNamesNormalizing {
+		resp.Header.DisableNormalizing()
+	}
+	err = resp.ReadLimitBody(cc.br, c.MaxResponseBodySize)
+
+	usable := stop()
+	if err != nil || !usable || req.ConnectionClose() || resp.ConnectionClose() ||
+		(c.MaxConnDuration > 0 && time.Since(cc.created) > c.MaxConnDuration) {
+		cc.Close()
+		return err
+	}
+	c.putH1Conn(key, cc)
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func earliest(deadline time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return deadline
+	}
+	t := time.Now().Add(timeout)
+	if deadline.IsZero() || t.Before(deadline) {
+		return t
+	}
+	return deadline
+}
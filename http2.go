@@ -0,0 +1,1238 @@
+package v2fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// h2Transport speaks HTTP/2 straight from fasthttp's Request and into its
+// Response: headers are HPACK-encoded from the fasthttp header and DATA
+// frames are appended to the response body buffer, with no net/http types in
+// between.
+
+const (
+	h2StreamWindow      = 4 << 20
+	h2ConnWindow        = 1 << 30
+	h2MaxHeaderListSize = 10 << 20
+	h2DefaultWindow     = 65535
+	h2DefaultFrameSize  = 16 << 10
+	h2DialTimeout       = 15 * time.Second
+)
+
+var (
+	errH2Unsupported  = errors.New("server did not negotiate h2")
+	errH2ConnClosed   = errors.New("http2: client connection closed")
+	errH2RetryRequest = errors.New("http2: request was not processed by the server")
+	errH2StreamDone   = errors.New("http2: stream already finished")
+)
+
+type h2Transport struct {
+	c *Client
+	// cleartext sends http:// requests as HTTP/2 with prior knowledge (h2c).
+	cleartext bool
+
+	mu       sync.Mutex
+	conns    map[string][]*h2Conn
+	dials    map[string]*h2DialCall
+	noH2     map[string]bool
+	cleaning bool
+}
+
+type h2DialCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newH2Transport(c *Client) *h2Transport {
+	return &h2Transport{c: c}
+}
+
+func (t *h2Transport) roundTrip(ctx context.Context, req *Request, resp *Response) error {
+	uri := req.URI()
+	var addr string
+	switch {
+	case string(uri.Scheme()) == "https":
+		addr = fasthttp.AddMissingPort(string(uri.Host()), true)
+	case t.cleartext && string(uri.Scheme()) == "http":
+		// Cleartext connections are pooled apart from TLS ones to the same
+		// address.
+		addr = "http://" + fasthttp.AddMissingPort(string(uri.Host()), false)
+	default:
+		return t.c.doCtxHTTP1(ctx, req, resp)
+	}
+
+	// Connections through a request's own proxy are pooled apart.
+	addr = proxyPoolKey(requestProxyFromContext(ctx)) + addr
+
+	t.c.setUserAgent(req)
+	uri.DisablePathNormalizing = t.c.DisablePathNormalizing
+	for attempt := 0; ; attempt++ {
+		cc, err := t.getConn(ctx, addr)
+		if err == errH2Unsupported {
+			return t.c.doCtxHTTP1(ctx, req, resp)
+		}
+		if err != nil {
+			return ctxError(ctx, err)
+		}
+		err = cc.roundTrip(ctx, req, resp)
+		if errors.Is(err, errH2RetryRequest) && attempt < 2 && !req.IsBodyStream() {
+			continue
+		}
+		return ctxError(ctx, err)
+	}
+}
+
+func (t *h2Transport) getConn(ctx context.Context, addr string) (*h2Conn, error) {
+	for {
+		t.mu.Lock()
+		if t.noH2[addr] {
+			t.mu.Unlock()
+			return nil, errH2Unsupported
+		}
+		conns := t.conns[addr]
+		for _, cc := range conns {
+			if cc.idleExpired() {
+				go cc.close(errH2ConnClosed)
+				continue
+			}
+			if cc.reserveStream() {
+				t.mu.Unlock()
+				return cc, nil
+			}
+		}
+		if len(conns) > 0 && len(conns) >= t.maxConns() {
+			// Out of connections: queue on the least loaded one.
+			cc := conns[0]
+			for _, c := range conns[1:] {
+				if c.load() < cc.load() {
+					cc = c
+				}
+			}
+			t.mu.Unlock()
+			if err := cc.waitReserveStream(ctx); err != nil {
+				if err == errH2ConnClosed {
+					continue
+				}
+				return nil, err
+			}
+			return cc, nil
+		}
+		if err := t.waitDialLocked(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// connect makes sure there is a connection to addr without sending anything
+// on it. A server that only speaks HTTP/1.1 counts as connected.
+func (t *h2Transport) connect(ctx context.Context, addr string) error {
+	t.mu.Lock()
+	if t.noH2[addr] || len(t.conns[addr]) > 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if err := t.waitDialLocked(ctx, addr); err != nil && err != errH2Unsupported {
+		return err
+	}
+	return nil
+}
+
+// waitDialLocked starts dialing addr unless a dial is already in flight and
+// waits for it. t.mu must be held and is released.
+func (t *h2Transport) waitDialLocked(ctx context.Context, addr string) error {
+	call := t.dials[addr]
+	if call == nil {
+		call = &h2DialCall{done: make(chan struct{})}
+		if t.dials == nil {
+			t.dials = make(map[string]*h2DialCall)
+		}
+		t.dials[addr] = call
+		go t.dial(addr, call)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dial runs detached from the request that triggered it, so that a caller
+// giving up does not tear down a connection other requests are waiting for.
+func (t *h2Transport) dial(addr string, call *h2DialCall) {
+	timeout := t.c.ReadTimeout + t.c.WriteTimeout
+	if timeout <= 0 {
+		timeout = h2DialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cc, err := t.dialConn(ctx, addr)
+
+	t.mu.Lock()
+	delete(t.dials, addr)
+	switch {
+	case err == errH2Unsupported:
+		if t.noH2 == nil {
+			t.noH2 = make(map[string]bool)
+		}
+		t.noH2[addr] = true
+	case err == nil:
+		if t.conns == nil {
+			t.conns = make(map[string][]*h2Conn)
+		}
+		t.conns[addr] = append(t.conns[addr], cc)
+		if maxIdle := t.c.MaxIdleConnDuration; maxIdle > 0 && !t.cleaning {
+			t.cleaning = true
+			go t.clean(maxIdle)
+		}
+	}
+	call.err = err
+	t.mu.Unlock()
+	close(call.done)
+}
+
+// forget closes the idle connections whose pool key starts with prefix and
+// drops which of their servers only speak HTTP/1.1.
+func (t *h2Transport) forget(prefix string) {
+	t.mu.Lock()
+	for key := range t.noH2 {
+		if strings.HasPrefix(key, prefix) {
+			delete(t.noH2, key)
+		}
+	}
+	t.mu.Unlock()
+	t.closeIdle(prefix)
+}
+
+func (t *h2Transport) dialConn(ctx context.Context, key string) (*h2Conn, error) {
+	prefix, addr, proxy, err := splitProxyPoolKey(key)
+	if err != nil {
+		return nil, err
+	}
+	dial := t.c.proxyDialer(proxy)
+	if hostPort, ok := strings.CutPrefix(addr, "http://"); ok {
+		conn, err := dial(ctx, "tcp", hostPort)
+		if err != nil {
+			return nil, err
+		}
+		return t.newConn(key, conn)
+	}
+	conn, err := dialTLS(ctx, dial, addr, clientTLSConfig(sessionsThrough(t.c.TLSConfig, proxy), addr, "h2", "http/1.1"))
+	if err != nil {
+		return nil, err
+	}
+	if cs, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok && cs.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		// The server only speaks HTTP/1.1: keep the connection for the
+		// HTTP/1.1 path instead of wasting the handshake.
+		t.c.putH1Conn(prefix+"https://"+addr, t.c.newH1Conn(conn))
+		return nil, errH2Unsupported
+	}
+	return t.newConn(key, conn)
+}
+
+func (t *h2Transport) maxConns() int {
+	if t.c.MaxConnsPerHost > 0 {
+		return t.c.MaxConnsPerHost
+	}
+	return fasthttp.DefaultMaxConnsPerHost
+}
+
+func (t *h2Transport) removeConn(cc *h2Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := t.conns[cc.addr]
+	for i, c := range conns {
+		if c == cc {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(t.conns, cc.addr)
+	} else {
+		t.conns[cc.addr] = conns
+	}
+}
+
+// clean closes the connections left idle for maxIdle, like fasthttp's
+// connection cleaner, until there are none left.
+func (t *h2Transport) clean(maxIdle time.Duration) {
+	for {
+		time.Sleep(maxIdle)
+
+		t.mu.Lock()
+		var expired []*h2Conn
+		total := 0
+		for _, conns := range t.conns {
+			total += len(conns)
+			for _, cc := range conns {
+				if cc.idleExpired() {
+					expired = append(expired, cc)
+				}
+			}
+		}
+		done := len(expired) == total
+		if done {
+			t.cleaning = false
+		}
+		t.mu.Unlock()
+
+		for _, cc := range expired {
+			cc.close(errH2ConnClosed)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func (t *h2Transport) closeIdleConnections() {
+	t.closeIdle("")
+}
+
+// closeIdle closes the idle connections whose pool key starts with prefix.
+func (t *h2Transport) closeIdle(prefix string) {
+	t.mu.Lock()
+	var idle []*h2Conn
+	for key, conns := range t.conns {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, cc := range conns {
+			if cc.load() == 0 {
+				idle = append(idle, cc)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, cc := range idle {
+		cc.close(errH2ConnClosed)
+	}
+}
+
+type h2Conn struct {
+	t      *h2Transport
+	addr   string
+	scheme string
+	conn   net.Conn
+
+	// wmu serializes frame writes and guards the HPACK encoder.
+	wmu  sync.Mutex
+	bw   *bufio.Writer
+	fr   *http2.Framer
+	henc *hpack.Encoder
+	hbuf bytes.Buffer
+	kbuf []byte
+
+	mu               sync.Mutex
+	cond             *sync.Cond
+	streams          map[uint32]*h2Stream
+	nextStreamID     uint32
+	reserved         int
+	maxStreams       uint32
+	peerWindow       int32
+	peerMaxFrameSize uint32
+	sendWindow       int32
+	recvUnacked      int32
+	goAway           bool
+	closed           bool
+	closeErr         error
+	idleSince        time.Time
+}
+
+type h2Stream struct {
+	id       uint32
+	resp     *Response
+	skipBody bool
+	maxBody  int
+	done     chan struct{}
+
+	// body and headers are set when the response body is streamed;
+	// headers is closed once the response headers are in resp.
+	body          *h2BodyReader
+	headers       chan struct{}
+	contentLength int
+
+	// trailer is set by the read loop before done is closed.
+	trailer []hpack.HeaderField
+
+	// sendWindow is guarded by the connection's mu.
+	sendWindow int32
+
+	// mu guards the response against a caller that gave up on the stream.
+	mu          sync.Mutex
+	cancelled   bool
+	gotHeaders  bool
+	recvUnacked int32
+	err         error
+}
+
+// h2BodyReader is the body stream of a streamed response. It holds at most
+// one stream window of data.
+type h2BodyReader struct {
+	cc     *h2Conn
+	cs     *h2Stream
+	notify chan struct{}
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	unacked int32
+	closed  bool
+}
+
+func (b *h2BodyReader) write(p []byte) {
+	b.mu.Lock()
+	b.buf.Write(p)
+	b.mu.Unlock()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *h2BodyReader) Read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return 0, errH2StreamDone
+		}
+		if b.buf.Len() > 0 {
+			n, _ := b.buf.Read(p)
+			b.unacked += int32(n)
+			inc := int32(0)
+			if b.unacked >= h2StreamWindow/2 {
+				inc, b.unacked = b.unacked, 0
+			}
+			b.mu.Unlock()
+			if inc > 0 && !b.finished() {
+				err := b.cc.writeControl(func() error { return b.cc.fr.WriteWindowUpdate(b.cs.id, uint32(inc)) })
+				if err != nil {
+					b.cc.close(err)
+				}
+			}
+			return n, nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.notify:
+		case <-b.cs.done:
+			// Everything the stream carried was written before done was
+			// closed.
+			b.mu.Lock()
+			empty := b.buf.Len() == 0
+			b.mu.Unlock()
+			if !empty {
+				continue
+			}
+			if b.cs.err != nil {
+				return 0, b.cs.err
+			}
+			addH2Trailers(b.cs.resp, b.cs.trailer)
+			b.cs.trailer = nil
+			return 0, io.EOF
+		}
+	}
+}
+
+func (b *h2BodyReader) finished() bool {
+	select {
+	case <-b.cs.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close resets the stream if the body wasn't read to the end.
+func (b *h2BodyReader) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.buf.Reset()
+	b.mu.Unlock()
+	if !b.finished() {
+		b.cc.cancelStream(b.cs, http2.ErrCodeCancel)
+	}
+	return nil
+}
+
+func (t *h2Transport) newConn(addr string, conn net.Conn) (*h2Conn, error) {
+	readBufferSize := t.c.ReadBufferSize
+	if readBufferSize <= 0 {
+		readBufferSize = 16 << 10
+	}
+	writeBufferSize := t.c.WriteBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = 16 << 10
+	}
+	cc := &h2Conn{
+		t:                t,
+		addr:             addr,
+		scheme:           "https",
+		conn:             conn,
+		bw:               bufio.NewWriterSize(conn, writeBufferSize),
+		streams:          make(map[uint32]*h2Stream),
+		nextStreamID:     1,
+		maxStreams:       100,
+		peerWindow:       h2DefaultWindow,
+		peerMaxFrameSize: h2DefaultFrameSize,
+		sendWindow:       h2DefaultWindow,
+		idleSince:        time.Now(),
+	}
+	if strings.HasPrefix(addr, "http://") {
+		cc.scheme = "http"
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+	cc.fr = http2.NewFramer(cc.bw, bufio.NewReaderSize(conn, readBufferSize))
+	cc.fr.SetReuseFrames()
+	cc.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	cc.fr.MaxHeaderListSize = h2MaxHeaderListSize
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+
+	if _, err := cc.bw.WriteString(http2.ClientPreface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err := cc.fr.WriteSettings(
+		http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2StreamWindow},
+		http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: h2MaxHeaderListSize},
+	)
+	if err == nil {
+		err = cc.fr.WriteWindowUpdate(0, h2ConnWindow-h2DefaultWindow)
+	}
+	if err == nil {
+		err = cc.bw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go cc.readLoop()
+	return cc, nil
+}
+
+func (cc *h2Conn) load() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.reserved
+}
+
+func (cc *h2Conn) reserveStream() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.canReserveLocked() {
+		return false
+	}
+	cc.reserved++
+	return true
+}
+
+func (cc *h2Conn) canReserveLocked() bool {
+	if cc.closed || cc.goAway || cc.nextStreamID >= 1<<31-1 {
+		return false
+	}
+	return uint32(cc.reserved) < cc.maxStreams
+}
+
+func (cc *h2Conn) waitReserveStream(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		cc.mu.Lock()
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+	})
+	defer stop()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for {
+		if cc.closed || cc.goAway {
+			return errH2ConnClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if uint32(cc.reserved) < cc.maxStreams {
+			cc.reserved++
+			return nil
+		}
+		cc.cond.Wait()
+	}
+}
+
+// releaseStreamLocked frees a stream slot and reports whether the connection
+// is done for good (drained after GOAWAY).
+func (cc *h2Conn) releaseStreamLocked() (drained bool) {
+	cc.reserved--
+	if cc.reserved == 0 {
+		cc.idleSince = time.Now()
+	}
+	cc.cond.Broadcast()
+	return cc.goAway && cc.reserved == 0
+}
+
+func (cc *h2Conn) idleExpired() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	maxIdle := cc.t.c.MaxIdleConnDuration
+	return cc.reserved == 0 && maxIdle > 0 && time.Since(cc.idleSince) > maxIdle
+}
+
+func (cc *h2Conn) roundTrip(ctx context.Context, req *Request, resp *Response) error {
+	skipBody := resp.SkipBody
+	streamBody := resp.StreamBody || cc.t.c.StreamResponseBody
+	resp.Reset()
+	resp.SkipBody = skipBody
+	resp.StreamBody = streamBody
+	if cc.t.c.DisableHeaderNamesNormalizing {
+		resp.Header.DisableNormalizing()
+	}
+
+	var body []byte
+	if !req.IsBodyStream() {
+		body = req.Body()
+	}
+	cs := &h2Stream{
+		resp:     resp,
+		skipBody: skipBody || req.Header.IsHead(),
+		maxBody:  cc.t.c.MaxResponseBodySize,
+		done:     make(chan struct{}),
+	}
+	if streamBody && !cs.skipBody {
+		cs.body = &h2BodyReader{cc: cc, cs: cs, notify: make(chan struct{}, 1)}
+		cs.headers = make(chan struct{})
+	}
+
+	if err := cc.writeHeaders(ctx, cs, req, len(body) == 0 && !req.IsBodyStream()); err != nil {
+		return err
+	}
+	var err error
+	if req.IsBodyStream() {
+		err = cc.writeBodyStream(ctx, cs, req.BodyStream())
+	} else if len(body) > 0 {
+		err = cc.writeBody(ctx, cs, body, true)
+	}
+	if err != nil && err != errH2StreamDone {
+		cc.cancelStream(cs, http2.ErrCodeCancel)
+		return err
+	}
+
+	select {
+	case <-cs.done:
+		if cs.err != nil {
+			return cs.err
+		}
+		if cs.body == nil {
+			if !cs.skipBody && cs.contentLength < 0 {
+				// Like fasthttp after reading a chunked body.
+				resp.Header.SetContentLength(len(resp.Body()))
+			}
+			addH2Trailers(resp, cs.trailer)
+		}
+	case <-cs.headers:
+		// Streaming: the body is read by the caller, not bound to ctx.
+	case <-ctx.Done():
+		cc.cancelStream(cs, http2.ErrCodeCancel)
+		return ctx.Err()
+	}
+	if cs.body != nil {
+		resp.SetBodyStream(deadlineBody(ctx, cs.body), cs.contentLength)
+	}
+	resp.Header.SetProtocol([]byte("HTTP/2.0"))
+	setRequestProtocol(ctx, "HTTP/2.0")
+	setRequestTLS(ctx, cc.conn)
+	return nil
+}
+
+// addH2Trailers adds trailer fields to resp's header, where fasthttp keeps
+// them, declaring the trailers the server didn't announce.
+func addH2Trailers(resp *Response, trailer []hpack.HeaderField) {
+	for _, hf := range trailer {
+		if !hasTrailerKey(resp, hf.Name) {
+			if err := resp.Header.AddTrailer(hf.Name); err != nil {
+				continue
+			}
+		}
+		resp.Header.Add(hf.Name, hf.Value)
+	}
+}
+
+var h2SkipRequestHeaders = map[string]bool{
+	"host":              true,
+	"connection":        true,
+	"proxy-connection":  true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+	"content-length":    true,
+}
+
+// lockWrite takes wmu for a write that has to be done by ctx's deadline
+// and WriteTimeout, and is aborted once ctx is done. A frame cut short
+// leaves the connection unusable, so the writer closes it on error.
+func (cc *h2Conn) lockWrite(ctx context.Context) (unlock func()) {
+	cc.wmu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = cc.conn.SetWriteDeadline(earliest(deadline, cc.t.c.WriteTimeout))
+	if ctx.Done() == nil {
+		return cc.wmu.Unlock
+	}
+	aborted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = cc.conn.SetWriteDeadline(aLongTimeAgo)
+		close(aborted)
+	})
+	return func() {
+		if !stop() {
+			// The next writer's deadline must not be overwritten.
+			<-aborted
+		}
+		cc.wmu.Unlock()
+	}
+}
+
+func (cc *h2Conn) writeHeaders(ctx context.Context, cs *h2Stream, req *Request, endStream bool) error {
+	defer cc.lockWrite(ctx)()
+
+	uri := req.URI()
+	host := req.Header.Host()
+	if len(host) == 0 {
+		host = uri.Host()
+	}
+	method := req.Header.Method()
+
+	cc.hbuf.Reset()
+	// The encoder keeps fields in its dynamic table, so they must not alias
+	// fasthttp's header buffers.
+	cc.writeField(":method", string(method))
+	cc.writeField(":scheme", cc.scheme)
+	cc.writeField(":authority", string(host))
+	cc.writeField(":path", string(uri.RequestURI()))
+	req.Header.VisitAll(func(k, v []byte) {
+		cc.kbuf = appendLower(cc.kbuf[:0], k)
+		if h2SkipRequestHeaders[string(cc.kbuf)] {
+			return
+		}
+		if string(cc.kbuf) == "te" && !bytes.EqualFold(v, []byte("trailers")) {
+			return
+		}
+		cc.writeField(string(cc.kbuf), string(v))
+	})
+	if req.IsBodyStream() {
+		if n := req.Header.ContentLength(); n >= 0 {
+			cc.writeField("content-length", strconv.Itoa(n))
+		}
+	} else if n := len(req.Body()); n > 0 || methodExpectsBody(method) {
+		cc.writeField("content-length", strconv.Itoa(n))
+	}
+
+	cc.mu.Lock()
+	if cc.closed || cc.goAway {
+		cc.releaseStreamLocked()
+		cc.mu.Unlock()
+		return errH2RetryRequest
+	}
+	cs.id = cc.nextStreamID
+	cc.nextStreamID += 2
+	cs.sendWindow = cc.peerWindow
+	cc.streams[cs.id] = cs
+	maxFrameSize := int(cc.peerMaxFrameSize)
+	cc.mu.Unlock()
+
+	block := cc.hbuf.Bytes()
+	first := true
+	for len(block) > 0 || first {
+		chunk := block
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+		var err error
+		if first {
+			err = cc.fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      cs.id,
+				BlockFragment: chunk,
+				EndStream:     endStream,
+				EndHeaders:    len(block) == 0,
+			})
+			first = false
+		} else {
+			err = cc.fr.WriteContinuation(cs.id, len(block) == 0, chunk)
+		}
+		if err != nil {
+			return cc.headersFailed(ctx, err)
+		}
+	}
+	if err := cc.bw.Flush(); err != nil {
+		return cc.headersFailed(ctx, err)
+	}
+	return nil
+}
+
+// headersFailed closes the connection after a failed HEADERS write. The
+// request is retried on another connection unless ctx is done.
+func (cc *h2Conn) headersFailed(ctx context.Context, err error) error {
+	cc.close(err)
+	if ctxDone(ctx) != nil {
+		return err
+	}
+	return errH2RetryRequest
+}
+
+func (cc *h2Conn) writeField(name, value string) {
+	_ = cc.henc.WriteField(hpack.HeaderField{Name: name, Value: value})
+}
+
+// writeBody sends body on cs, ending the stream after it if endStream is
+// set. errH2StreamDone means the server answered without reading the rest.
+func (cc *h2Conn) writeBody(ctx context.Context, cs *h2Stream, body []byte, endStream bool) error {
+	stop := context.AfterFunc(ctx, func() {
+		cc.mu.Lock()
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+	})
+	defer stop()
+
+	if len(body) == 0 && endStream {
+		select {
+		case <-cs.done:
+			return errH2StreamDone
+		default:
+		}
+		return cc.writeData(ctx, cs, nil, true)
+	}
+	for len(body) > 0 {
+		n, err := cc.awaitSendWindow(ctx, cs, len(body))
+		if err != nil {
+			return err
+		}
+		if err := cc.writeData(ctx, cs, body[:n], endStream && n == len(body)); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return nil
+}
+
+func (cc *h2Conn) writeData(ctx context.Context, cs *h2Stream, data []byte, endStream bool) error {
+	unlock := cc.lockWrite(ctx)
+	err := cc.fr.WriteData(cs.id, endStream, data)
+	if err == nil {
+		err = cc.bw.Flush()
+	}
+	unlock()
+	if err != nil {
+		cc.close(err)
+	}
+	return err
+}
+
+// writeBodyStream copies r to cs as it is read, so that the body is never
+// held in memory as a whole.
+func (cc *h2Conn) writeBodyStream(ctx context.Context, cs *h2Stream, r io.Reader) error {
+	buf := make([]byte, h2DefaultFrameSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := cc.writeBody(ctx, cs, buf[:n], false); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return cc.writeBody(ctx, cs, nil, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (cc *h2Conn) awaitSendWindow(ctx context.Context, cs *h2Stream, want int) (int, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for {
+		if cc.closed {
+			return 0, cc.closeErr
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		select {
+		case <-cs.done:
+			// The server answered (or reset the stream) before reading the
+			// whole body; nothing more to send.
+			return 0, errH2StreamDone
+		default:
+		}
+		n := int32(want)
+		if n > int32(cc.peerMaxFrameSize) {
+			n = int32(cc.peerMaxFrameSize)
+		}
+		if n > cs.sendWindow {
+			n = cs.sendWindow
+		}
+		if n > cc.sendWindow {
+			n = cc.sendWindow
+		}
+		if n > 0 {
+			cs.sendWindow -= n
+			cc.sendWindow -= n
+			return int(n), nil
+		}
+		cc.cond.Wait()
+	}
+}
+
+func (cc *h2Conn) cancelStream(cs *h2Stream, code http2.ErrCode) {
+	cs.mu.Lock()
+	cs.cancelled = true
+	cs.mu.Unlock()
+	cc.removeStream(cs, code)
+}
+
+// resetStream fails cs with err on behalf of the read loop.
+func (cc *h2Conn) resetStream(cs *h2Stream, code http2.ErrCode, err error) {
+	if cc.removeStream(cs, code) {
+		cs.err = err
+		close(cs.done)
+	}
+}
+
+// removeStream sends RST_STREAM for cs if it is still active and reports
+// whether it was.
+func (cc *h2Conn) removeStream(cs *h2Stream, code http2.ErrCode) bool {
+	cc.mu.Lock()
+	_, active := cc.streams[cs.id]
+	drained := false
+	if active {
+		delete(cc.streams, cs.id)
+		drained = cc.releaseStreamLocked()
+	}
+	cc.mu.Unlock()
+	if !active {
+		return false
+	}
+	if drained {
+		cc.close(errH2ConnClosed)
+		return true
+	}
+	if err := cc.writeControl(func() error { return cc.fr.WriteRSTStream(cs.id, code) }); err != nil {
+		cc.close(err)
+	}
+	return true
+}
+
+// endStream removes cs from the connection and wakes up its caller.
+func (cc *h2Conn) endStream(cs *h2Stream, err error) {
+	cc.mu.Lock()
+	if _, ok := cc.streams[cs.id]; !ok {
+		cc.mu.Unlock()
+		return
+	}
+	delete(cc.streams, cs.id)
+	drained := cc.releaseStreamLocked()
+	cc.mu.Unlock()
+
+	cs.err = err
+	close(cs.done)
+	if drained {
+		cc.close(errH2ConnClosed)
+	}
+}
+
+func (cc *h2Conn) close(err error) {
+	cc.mu.Lock()
+	if cc.closed {
+		cc.mu.Unlock()
+		return
+	}
+	cc.closed = true
+	cc.closeErr = err
+	streams := cc.streams
+	cc.streams = make(map[uint32]*h2Stream)
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.t.removeConn(cc)
+	cc.conn.Close()
+	for _, cs := range streams {
+		cs.err = err
+		close(cs.done)
+	}
+}
+
+func (cc *h2Conn) stream(id uint32) *h2Stream {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.streams[id]
+}
+
+func (cc *h2Conn) readLoop() {
+	for {
+		f, err := cc.fr.ReadFrame()
+		if err != nil {
+			if se, ok := err.(http2.StreamError); ok {
+				if cs := cc.stream(se.StreamID); cs != nil {
+					cc.resetStream(cs, se.Code, se)
+				}
+				continue
+			}
+			if err == io.EOF {
+				err = errH2ConnClosed
+			}
+			cc.close(err)
+			return
+		}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			err = cc.processHeaders(f)
+		case *http2.DataFrame:
+			err = cc.processData(f)
+		case *http2.RSTStreamFrame:
+			if cs := cc.stream(f.StreamID); cs != nil {
+				var err error = http2.StreamError{StreamID: f.StreamID, Code: f.ErrCode}
+				if f.ErrCode == http2.ErrCodeRefusedStream {
+					err = errH2RetryRequest
+				}
+				cc.endStream(cs, err)
+			}
+		case *http2.SettingsFrame:
+			err = cc.processSettings(f)
+		case *http2.WindowUpdateFrame:
+			cc.processWindowUpdate(f)
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				err = cc.writeControl(func() error { return cc.fr.WritePing(true, f.Data) })
+			}
+		case *http2.GoAwayFrame:
+			cc.processGoAway(f)
+		}
+		if err != nil {
+			cc.close(err)
+			return
+		}
+	}
+}
+
+func (cc *h2Conn) writeControl(write func() error) error {
+	defer cc.lockWrite(context.Background())()
+	if err := write(); err != nil {
+		return err
+	}
+	return cc.bw.Flush()
+}
+
+func (cc *h2Conn) processHeaders(f *http2.MetaHeadersFrame) error {
+	cs := cc.stream(f.StreamID)
+	if cs == nil {
+		return nil
+	}
+	cs.mu.Lock()
+	if cs.cancelled {
+		cs.mu.Unlock()
+		return nil
+	}
+	if !cs.gotHeaders {
+		status, err := strconv.Atoi(f.PseudoValue("status"))
+		if err != nil {
+			cs.mu.Unlock()
+			cc.endStream(cs, fmt.Errorf("http2: invalid :status %q", f.PseudoValue("status")))
+			return nil
+		}
+		if status >= 100 && status < 200 {
+			// Informational responses are skipped, as in fasthttp.
+			cs.mu.Unlock()
+			return nil
+		}
+		cs.gotHeaders = true
+		resp := cs.resp
+		resp.SetStatusCode(status)
+		cs.contentLength = -1
+		for _, hf := range f.RegularFields() {
+			resp.Header.Add(hf.Name, hf.Value)
+			if hf.Name == "content-length" {
+				if n, err := strconv.Atoi(hf.Value); err == nil && n >= 0 {
+					cs.contentLength = n
+				}
+			}
+		}
+		resp.SkipBody = cs.skipBody
+		if cs.headers != nil {
+			close(cs.headers)
+		}
+	} else if f.StreamEnded() {
+		cs.trailer = append(cs.trailer, f.RegularFields()...)
+	}
+	cs.mu.Unlock()
+	if f.StreamEnded() {
+		cc.endStream(cs, nil)
+	}
+	return nil
+}
+
+func (cc *h2Conn) processData(f *http2.DataFrame) error {
+	n := int32(f.Length)
+	cs := cc.stream(f.StreamID)
+	if n > 0 {
+		cc.mu.Lock()
+		cc.recvUnacked += n
+		connInc := int32(0)
+		if cc.recvUnacked >= h2ConnWindow/2 {
+			connInc, cc.recvUnacked = cc.recvUnacked, 0
+		}
+		cc.mu.Unlock()
+		if connInc > 0 {
+			if err := cc.writeControl(func() error { return cc.fr.WriteWindowUpdate(0, uint32(connInc)) }); err != nil {
+				return err
+			}
+		}
+	}
+	if cs == nil {
+		return nil
+	}
+
+	cs.mu.Lock()
+	if cs.cancelled {
+		cs.mu.Unlock()
+		return nil
+	}
+	if !cs.gotHeaders {
+		cs.mu.Unlock()
+		cc.resetStream(cs, http2.ErrCodeProtocol, errors.New("http2: DATA frame before response headers"))
+		return nil
+	}
+	streamInc := int32(0)
+	switch {
+	case cs.body != nil:
+		// The stream window is replenished as the caller reads.
+		cs.body.write(f.Data())
+	case !cs.skipBody && cs.maxBody > 0 && len(cs.resp.Body())+len(f.Data()) > cs.maxBody:
+		cs.mu.Unlock()
+		cc.resetStream(cs, http2.ErrCodeCancel, fasthttp.ErrBodyTooLarge)
+		return nil
+	default:
+		if !cs.skipBody {
+			cs.resp.AppendBody(f.Data())
+		}
+		cs.recvUnacked += n
+		if cs.recvUnacked >= h2StreamWindow/2 && !f.StreamEnded() {
+			streamInc, cs.recvUnacked = cs.recvUnacked, 0
+		}
+	}
+	cs.mu.Unlock()
+
+	if streamInc > 0 {
+		if err := cc.writeControl(func() error { return cc.fr.WriteWindowUpdate(cs.id, uint32(streamInc)) }); err != nil {
+			return err
+		}
+	}
+	if f.StreamEnded() {
+		cc.endStream(cs, nil)
+	}
+	return nil
+}
+
+func (cc *h2Conn) processSettings(f *http2.SettingsFrame) error {
+	if f.IsAck() {
+		return nil
+	}
+	var headerTableSize *uint32
+	cc.mu.Lock()
+	err := f.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID {
+		case http2.SettingMaxConcurrentStreams:
+			cc.maxStreams = s.Val
+		case http2.SettingInitialWindowSize:
+			delta := int32(s.Val) - cc.peerWindow
+			cc.peerWindow = int32(s.Val)
+			for _, cs := range cc.streams {
+				cs.sendWindow += delta
+			}
+		case http2.SettingMaxFrameSize:
+			cc.peerMaxFrameSize = s.Val
+		case http2.SettingHeaderTableSize:
+			headerTableSize = &s.Val
+		}
+		return nil
+	})
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return cc.writeControl(func() error {
+		if headerTableSize != nil {
+			cc.henc.SetMaxDynamicTableSizeLimit(*headerTableSize)
+		}
+		return cc.fr.WriteSettingsAck()
+	})
+}
+
+func (cc *h2Conn) processWindowUpdate(f *http2.WindowUpdateFrame) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if f.StreamID == 0 {
+		cc.sendWindow += int32(f.Increment)
+	} else if cs := cc.streams[f.StreamID]; cs != nil {
+		cs.sendWindow += int32(f.Increment)
+	}
+	cc.cond.Broadcast()
+}
+
+func (cc *h2Conn) processGoAway(f *http2.GoAwayFrame) {
+	cc.mu.Lock()
+	cc.goAway = true
+	drained := cc.reserved == 0
+	var unprocessed []*h2Stream
+	for id, cs := range cc.streams {
+		if id > f.LastStreamID {
+			unprocessed = append(unprocessed, cs)
+		}
+	}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.t.removeConn(cc)
+	for _, cs := range unprocessed {
+		cc.endStream(cs, errH2RetryRequest)
+	}
+	if drained {
+		cc.close(errH2ConnClosed)
+	}
+}
+
+func appendLower(dst, s []byte) []byte {
+	for _, b := range s {
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+func methodExpectsBody(method []byte) bool {
+	switch string(method) {
+	case fasthttp.MethodPost, fasthttp.MethodPut, fasthttp.MethodPatch:
+		return true
+	}
+	return false
+}
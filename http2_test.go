@@ -0,0 +1,284 @@
+package v2fasthttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+func newNativeH2Client(opt ClientOptions) *Client {
+	opt.HTTPVersion = HTTP2
+	opt.TLSConfig = testClientTLSConfig()
+	return NewClientWithOptions(opt)
+}
+
+func TestNativeHTTP2LargeBodies(t *testing.T) {
+	srv := newTestH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		_, _ = io.Copy(w, r.Body)
+	}))
+	c := newNativeH2Client(ClientOptions{})
+	defer c.CloseIdleConnections()
+	if c.current().h2 == nil {
+		t.Fatalf("expected the native HTTP/2 transport")
+	}
+
+	// Bigger than both the default and the advertised flow-control windows.
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<19)
+	got, status, err := c.PostBytes(srv.URL, body)
+	if err != nil {
+		t.Fatalf("PostBytes: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("echoed body mismatch: got %d bytes, want %d", len(got), len(body))
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(srv.URL)
+	req.Header.SetMethod(fasthttp.MethodPut)
+	req.SetBodyString("hello")
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if got := string(resp.Header.Peek("X-Proto")); got != "HTTP/2.0" {
+		t.Fatalf("X-Proto = %q, want HTTP/2.0", got)
+	}
+	if string(resp.Body()) != "hello" {
+		t.Fatalf("body = %q", resp.Body())
+	}
+}
+
+func TestNativeHTTP2MultiplexesOneConnection(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	c := newNativeH2Client(ClientOptions{})
+	defer c.CloseIdleConnections()
+
+	// Warm up so that the concurrent requests don't race to dial.
+	if _, _, err := c.GetBytes(srv.URL + "/warmup"); err != nil {
+		t.Fatalf("warmup: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _, err := c.GetBytes(srv.URL + "/x")
+			if err == nil && string(body) != "/x" {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("request failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestNativeHTTP2FallsBackToHTTP1(t *testing.T) {
+	// httptest's TLS server only offers http/1.1 unless EnableHTTP2 is set.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	defer srv.Close()
+
+	c := newNativeH2Client(ClientOptions{})
+	defer c.CloseIdleConnections()
+	for i := 0; i < 2; i++ {
+		body, _, err := c.GetBytes(srv.URL)
+		if err != nil {
+			t.Fatalf("GetBytes: %v", err)
+		}
+		if string(body) != "HTTP/1.1" {
+			t.Fatalf("body = %q, want HTTP/1.1", body)
+		}
+	}
+}
+
+func TestNativeHTTP2MaxResponseBodySize(t *testing.T) {
+	srv := newTestH2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 64<<10))
+	}))
+	c := newNativeH2Client(ClientOptions{MaxResponseBodySize: 1024})
+	defer c.CloseIdleConnections()
+
+	if _, _, err := c.GetBytes(srv.URL); err != fasthttp.ErrBodyTooLarge {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+	// The connection survives a reset stream.
+	c.MaxResponseBodySize = 0
+	body, _, err := c.GetBytes(srv.URL)
+	if err != nil || len(body) != 64<<10 {
+		t.Fatalf("GetBytes after reset: %d bytes, %v", len(body), err)
+	}
+}
+
+func TestNativeHTTP2ReadTimeout(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	c := newNativeH2Client(ClientOptions{ReadTimeout: 100 * time.Millisecond})
+	defer c.CloseIdleConnections()
+
+	start := time.Now()
+	_, _, err := c.GetBytes(srv.URL + "/slow")
+	if err == nil {
+		t.Fatalf("expected a timeout")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("request took %v", elapsed)
+	}
+}
+
+func TestNativeHTTP2ClosesIdleConnections(t *testing.T) {
+	var closed atomic.Int32
+	srv := httptest.NewUnstartedServer(protoEchoHandler())
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := newNativeH2Client(ClientOptions{H2C: true, MaxIdleConnDuration: 50 * time.Millisecond})
+	if body, _, err := c.GetBytes(srv.URL + "/"); err != nil || string(body) != "HTTP/2.0" {
+		t.Fatalf("GetBytes: %q, %v", body, err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for closed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the idle connection wasn't closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestNativeHTTP2CtxAbortsBlockedWrite sends a body to a server that stops
+// reading: cancelling the request must not wait for the write.
+func TestNativeHTTP2CtxAbortsBlockedWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+			return
+		}
+		// Open the flow-control windows wide, then stop reading.
+		fr := http2.NewFramer(conn, nil)
+		_ = fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1<<31 - 1})
+		_ = fr.WriteWindowUpdate(0, 1<<31-1-65535)
+		time.Sleep(10 * time.Second)
+	}()
+
+	c := newNativeH2Client(ClientOptions{H2C: true})
+	defer c.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = c.DoBytesCtx(ctx, fasthttp.MethodPost, "http://"+ln.Addr().String()+"/", make([]byte, 64<<20))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the blocked write took %v to abort", elapsed)
+	}
+}
+
+func TestDisableNativeHTTP2(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	c := newNativeH2Client(ClientOptions{DisableNativeHTTP2: true})
+	defer c.CloseIdleConnections()
+	if c.current().h2 != nil {
+		t.Fatalf("expected net/http to be used")
+	}
+	body, _, err := c.GetBytes(srv.URL)
+	if err != nil {
+		t.Fatalf("GetBytes: %v", err)
+	}
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("body = %q, want HTTP/2.0", body)
+	}
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	srv := newTestH2CServer(t, protoEchoHandler())
+	for _, native := range []bool{true, false} {
+		c := newNativeH2Client(ClientOptions{H2C: true, DisableNativeHTTP2: !native})
+		body, info := doWithInfo(t, c, srv.URL)
+		if body != "HTTP/2.0" || info.Protocol != "HTTP/2.0" {
+			t.Fatalf("native=%v: body %q, info %+v", native, body, info)
+		}
+		c.CloseIdleConnections()
+	}
+
+	c := newNativeH2Client(ClientOptions{})
+	defer c.CloseIdleConnections()
+	if body, _ := doWithInfo(t, c, srv.URL); body != "HTTP/1.1" {
+		t.Fatalf("without H2C: body %q, want HTTP/1.1", body)
+	}
+}
+
+func TestH2CThroughSOCKS5Proxy(t *testing.T) {
+	srv := newTestH2CServer(t, protoEchoHandler())
+	proxy := newTestSOCKS5Server(t, false)
+	c := newNativeH2Client(ClientOptions{H2C: true, SOCKS5Proxy: proxy.URL()})
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 3; i++ {
+		if body, _ := doWithInfo(t, c, srv.URL); body != "HTTP/2.0" {
+			t.Fatalf("request %d: body %q, want HTTP/2.0", i, body)
+		}
+	}
+	if n := proxy.connects.Load(); n != 1 {
+		t.Fatalf("expected 1 proxied connection, got %d", n)
+	}
+}
@@ -0,0 +1,299 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// MASQUE proxies (RFC 9298): the client keeps one HTTP/3 connection to the
+// proxy and opens a CONNECT-UDP stream per QUIC connection it makes. The
+// tunnelled QUIC packets travel as HTTP Datagrams with context ID 0.
+
+const (
+	defaultMASQUETemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+	masqueOuterPacketSize = 1350
+)
+
+var errMASQUENoTCP = errors.New("masque proxies only carry HTTP/3 (UDP) traffic")
+
+type masqueDialer struct {
+	proxyAddr string
+	template  string
+	auth      string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *http3.ClientConn
+}
+
+func newMASQUEDialer(p ProxySpec, tlsConfig *tls.Config) *masqueDialer {
+	d := &masqueDialer{proxyAddr: p.Addr, template: defaultMASQUETemplate}
+	if strings.Contains(p.Path, "{target_host}") {
+		d.template = p.Path
+	}
+	if p.Username != "" || p.Password != "" {
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
+	}
+	d.tlsConfig = clientTLSConfig(sessionsVia(tlsConfig, nil), d.proxyAddr, http3.NextProtoH3)
+	if d.tlsConfig.ServerName == "" {
+		d.tlsConfig.ServerName = p.hostname()
+	}
+	return d
+}
+
+// proxyConn returns the HTTP/3 connection to the proxy, dialing it if needed.
+func (d *masqueDialer) proxyConn(ctx context.Context) (*http3.ClientConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+	// The outer packets have to be larger than the smallest packets the
+	// tunnelled connection sends (1200 bytes).
+	conn, err := quic.DialAddr(ctx, d.proxyAddr, d.tlsConfig, &quic.Config{
+		EnableDatagrams:   true,
+		InitialPacketSize: masqueOuterPacketSize,
+		KeepAlivePeriod:   15 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tr := &http3.Transport{EnableDatagrams: true}
+	cc := tr.NewClientConn(conn)
+	select {
+	case <-cc.ReceivedSettings():
+	case <-ctx.Done():
+		_ = conn.CloseWithError(0, "")
+		return nil, ctx.Err()
+	case <-conn.Context().Done():
+		return nil, context.Cause(conn.Context())
+	}
+	if !cc.Settings().EnableDatagrams || !cc.Settings().EnableExtendedConnect {
+		_ = conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("masque proxy %s doesn't support HTTP Datagrams", d.proxyAddr)
+	}
+	d.conn = cc
+	return cc, nil
+}
+
+// dialQUIC is the http3.Transport dialer for MASQUE proxies.
+func (d *masqueDialer) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	pc, err := d.connectUDP(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Tunnelled packets must fit in a datagram of the outer connection.
+	if cfg == nil {
+		cfg = &quic.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	cfg.InitialPacketSize = 1200
+	cfg.DisablePathMTUDiscovery = true
+
+	tr := &quic.Transport{Conn: pc}
+	conn, err := tr.DialEarly(ctx, pc.target, tlsCfg, cfg)
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, err
+	}
+	context.AfterFunc(conn.Context(), func() {
+		tr.Close()
+		pc.Close()
+	})
+	return conn, nil
+}
+
+// targetURL expands the URI template for host and port. The variables are
+// percent-encoded, ':' of IPv6 addresses included (RFC 9298, Section 2).
+func (d *masqueDialer) targetURL(host, port string) *url.URL {
+	escape := func(s string) string {
+		return strings.ReplaceAll(url.PathEscape(s), ":", "%3A")
+	}
+	rawPath := strings.NewReplacer(
+		"{target_host}", escape(host),
+		"{target_port}", escape(port),
+	).Replace(d.template)
+	u := &url.URL{Scheme: "https", Host: d.proxyAddr, Path: rawPath}
+	if path, err := url.PathUnescape(rawPath); err == nil && path != rawPath {
+		u.Path, u.RawPath = path, rawPath
+	}
+	return u
+}
+
+func (d *masqueDialer) connectUDP(ctx context.Context, addr string) (*masquePacketConn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := d.proxyConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		Host:   d.proxyAddr,
+		URL:    d.targetURL(host, port),
+		Header: http.Header{"Capsule-Protocol": {"?1"}},
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+	})
+	var resp *http.Response
+	err = str.SendRequestHeader(req)
+	if err == nil {
+		resp, err = str.ReadResponse()
+	}
+	if !stop() {
+		return nil, ctxError(ctx, err)
+	}
+	if err != nil {
+		str.Close()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		str.Close()
+		return nil, fmt.Errorf("masque proxy refused CONNECT-UDP to %s: status code: %d", addr, resp.StatusCode)
+	}
+
+	pc := &masquePacketConn{
+		str:    str,
+		target: masqueAddr(addr),
+		local:  cc.Conn().LocalAddr(),
+	}
+	pc.ctx, pc.cancel = context.WithCancel(context.Background())
+	return pc, nil
+}
+
+// masqueAddr is the tunnel's target. The proxy resolves it, so it's kept as
+// host:port.
+type masqueAddr string
+
+func (a masqueAddr) Network() string { return "udp" }
+func (a masqueAddr) String() string  { return string(a) }
+
+type masquePacketConn struct {
+	str    *http3.RequestStream
+	target masqueAddr
+	local  net.Addr
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	readCancel    context.CancelFunc
+	writeDeadline time.Time
+	wbuf          []byte
+}
+
+func (c *masquePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.readCancel = cancel
+		c.mu.Unlock()
+
+		if !deadline.IsZero() {
+			if !time.Now().Before(deadline) {
+				cancel()
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+		}
+		b, err := c.str.ReceiveDatagram(ctx)
+		cancel()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return 0, nil, net.ErrClosed
+			}
+			if ctx.Err() != nil {
+				// The deadline passed or changed: check again.
+				continue
+			}
+			return 0, nil, err
+		}
+		contextID, n, err := quicvarint.Parse(b)
+		if err != nil || contextID != 0 {
+			continue
+		}
+		return copy(p, b[n:]), c.target, nil
+	}
+}
+
+func (c *masquePacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// SendDatagram only queues the datagram and never blocks, so a write
+	// deadline can only have passed before the call.
+	if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.wbuf = append(quicvarint.Append(c.wbuf[:0], 0), p...)
+	if err := c.str.SendDatagram(c.wbuf); err != nil {
+		var tooLarge *quic.DatagramTooLargeError
+		if errors.As(err, &tooLarge) {
+			// Like a packet dropped on the path.
+			return len(p), nil
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *masquePacketConn) Close() error {
+	c.cancel()
+	c.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return c.str.Close()
+}
+
+func (c *masquePacketConn) LocalAddr() net.Addr { return c.local }
+
+func (c *masquePacketConn) SetDeadline(t time.Time) error {
+	_ = c.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+func (c *masquePacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.readCancel != nil {
+		c.readCancel()
+	}
+	return nil
+}
+
+func (c *masquePacketConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,132 @@
+package v2fasthttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestHTTP3OverMASQUE(t *testing.T) {
+	base := newTestH3Server(t, protoEchoHandler())
+	proxy := newTestMASQUEServer(t, 0)
+	proxy.auth = "Basic dXNlcjpwYXNz"
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP3,
+		TLSConfig:   testClientTLSConfig(),
+		MASQUEProxy: "masque://user:pass@" + proxy.addr,
+	})
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		body, info := doWithInfo(t, c, base)
+		if body != "HTTP/3.0" || info.Protocol != "HTTP/3.0" || info.Downgraded {
+			t.Fatalf("request %d: body %q, info %+v", i, body, info)
+		}
+	}
+	if n := proxy.tunnels.Load(); n != 1 {
+		t.Fatalf("expected 1 CONNECT-UDP tunnel, got %d", n)
+	}
+	if proxy.datagrams.Load() == 0 {
+		t.Fatalf("expected datagrams to be relayed by the proxy")
+	}
+}
+
+func TestHTTP3OverMASQUERefused(t *testing.T) {
+	base := newTestH3Server(t, protoEchoHandler())
+	proxy := newTestMASQUEServer(t, http.StatusForbidden)
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP3,
+		TLSConfig:   testClientTLSConfig(),
+	})
+	c.SetProxy(proxy.URL())
+	defer c.CloseIdleConnections()
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(base)
+	err := c.DoCtx(context.Background(), req, resp)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the proxy's 403 to be reported, got %v", err)
+	}
+	if c.HTTP3Downgrade() != nil {
+		t.Fatalf("MASQUE clients must not downgrade to HTTP/2")
+	}
+}
+
+func TestMASQUEProxyRejectsTCP(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP2,
+		TLSConfig:   testClientTLSConfig(),
+		MASQUEProxy: "masque://127.0.0.1:1",
+	})
+	defer c.CloseIdleConnections()
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(srv.URL)
+	if err := c.Do(req, resp); !errors.Is(err, errMASQUENoTCP) {
+		t.Fatalf("expected errMASQUENoTCP, got %v", err)
+	}
+}
+
+func TestMASQUETargetURL(t *testing.T) {
+	tests := []struct {
+		template, host, want string
+	}{
+		{defaultMASQUETemplate, "example.com", "/.well-known/masque/udp/example.com/443/"},
+		{defaultMASQUETemplate, "192.0.2.1", "/.well-known/masque/udp/192.0.2.1/443/"},
+		{defaultMASQUETemplate, "2001:db8::1", "/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/"},
+		{"/udp/{target_host}/{target_port}/", "2001:db8::1", "/udp/2001%3Adb8%3A%3A1/443/"},
+	}
+	for _, tc := range tests {
+		d := &masqueDialer{proxyAddr: "proxy:443", template: tc.template}
+		if got := d.targetURL(tc.host, "443").RequestURI(); got != tc.want {
+			t.Errorf("%s with %s: got %q, want %q", tc.template, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestMASQUEPacketConnWriteDeadline(t *testing.T) {
+	proxy := newTestMASQUEServer(t, 0)
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer target.Close()
+
+	d := newMASQUEDialer(ProxySpec{Scheme: "masque", Addr: proxy.addr}, testClientTLSConfig())
+	pc, err := d.connectUDP(context.Background(), target.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("connectUDP: %v", err)
+	}
+	defer pc.Close()
+
+	pc.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := pc.WriteTo([]byte("late"), nil); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	pc.SetWriteDeadline(time.Time{})
+	if _, err := pc.WriteTo([]byte("ping"), nil); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, _, err := target.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("target got %q, %v", buf[:n], err)
+	}
+}
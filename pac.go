@@ -0,0 +1,374 @@
+package v2fasthttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Proxy auto-config (PAC) scripts are run by goja in a runtime of their own
+// that has nothing but the ECMAScript built-ins and the standard PAC
+// functions: no file, network or timer access, and a time limit per call.
+// They are consulted for every request, with its full URL, and the request
+// then goes through the pools kept for proxies set with WithProxy.
+
+const (
+	pacFetchTimeout = 10 * time.Second
+	pacDNSTimeout   = 2 * time.Second
+	pacCacheFor     = time.Minute
+	pacCacheSize    = 1024
+)
+
+// pacEvalTimeout bounds each run of the script.
+var pacEvalTimeout = time.Second
+
+type pacResult struct {
+	// proxies are tried in order; a zero ProxySpec is DIRECT.
+	proxies []ProxySpec
+	expires time.Time
+}
+
+type pacScript struct {
+	mu   sync.Mutex
+	vm   *goja.Runtime
+	find goja.Callable
+
+	cacheMu sync.Mutex
+	cache   map[string]pacResult
+}
+
+// loadPAC returns the script pac, or fetches it if pac is an http(s) URL,
+// with c's TLS config and proxy settings.
+func (c *Client) loadPAC(pac string) (string, error) {
+	if !strings.HasPrefix(pac, "http://") && !strings.HasPrefix(pac, "https://") {
+		return pac, nil
+	}
+	tr := &http.Transport{
+		TLSClientConfig: sessionsThrough(c.TLSConfig, nil),
+		Proxy:           c.netHTTPProxy,
+		DialContext:     c.netHTTPDial,
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Timeout: pacFetchTimeout, Transport: tr}
+	resp, err := client.Get(pac)
+	if err != nil {
+		return "", fmt.Errorf("fetching PAC file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching PAC file: status %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("fetching PAC file: %w", err)
+	}
+	return string(b), nil
+}
+
+func newPACScript(src string) (*pacScript, error) {
+	vm := goja.New()
+	for name, fn := range map[string]any{
+		"dnsResolve":  pacDNSResolve,
+		"myIpAddress": pacMyIPAddress,
+		"isInNet":     pacIsInNet,
+		"alert":       func(string) {},
+	} {
+		if err := vm.Set(name, fn); err != nil {
+			return nil, err
+		}
+	}
+	s := &pacScript{vm: vm}
+	err := s.run(func() error {
+		if _, err := vm.RunString(pacUtils); err != nil {
+			return err
+		}
+		_, err := vm.RunScript("proxy.pac", src)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PAC script: %w", err)
+	}
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("PAC script: FindProxyForURL is not defined")
+	}
+	s.find = find
+	return s, nil
+}
+
+// run calls f with the runtime locked, interrupting it after pacEvalTimeout.
+func (s *pacScript) run(f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timer := time.AfterFunc(pacEvalTimeout, func() {
+		s.vm.Interrupt("timeout")
+	})
+	defer func() {
+		timer.Stop()
+		s.vm.ClearInterrupt()
+	}()
+	return f()
+}
+
+// proxiesFor returns the proxies for the request URL u, whose host is
+// host. Answers are cached for a while per URL.
+func (s *pacScript) proxiesFor(u, host string) ([]ProxySpec, error) {
+	now := time.Now()
+	s.cacheMu.Lock()
+	r, ok := s.cache[u]
+	s.cacheMu.Unlock()
+	if ok && now.Before(r.expires) {
+		return r.proxies, nil
+	}
+
+	var result string
+	err := s.run(func() error {
+		v, err := s.find(goja.Undefined(), s.vm.ToValue(u), s.vm.ToValue(host))
+		if err != nil {
+			return err
+		}
+		result = v.String()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PAC script: %w", err)
+	}
+	proxies, err := parsePACResult(result)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cacheMu.Lock()
+	if s.cache == nil || len(s.cache) >= pacCacheSize {
+		s.cache = make(map[string]pacResult)
+	}
+	s.cache[u] = pacResult{proxies: proxies, expires: now.Add(pacCacheFor)}
+	s.cacheMu.Unlock()
+	return proxies, nil
+}
+
+// parsePACResult parses a FindProxyForURL answer such as
+// "PROXY a:8080; SOCKS5 b:1080; DIRECT". An empty answer is DIRECT.
+func parsePACResult(result string) ([]ProxySpec, error) {
+	var proxies []ProxySpec
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			proxies = append(proxies, ProxySpec{})
+			continue
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS4":
+			scheme = "socks4"
+		case "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("PAC script: bad proxy %q", strings.TrimSpace(entry))
+		}
+		p, err := parseProxy(scheme+"://"+fields[1], scheme)
+		if err != nil {
+			return nil, fmt.Errorf("PAC script: %w", err)
+		}
+		proxies = append(proxies, p)
+	}
+	if len(proxies) == 0 {
+		proxies = append(proxies, ProxySpec{})
+	}
+	return proxies, nil
+}
+
+// doPAC sends the request through the proxies the script gives for its URL,
+// as if they had been set with WithProxy, moving on to the next one while a
+// proxy can't be reached.
+func (c *Client) doPAC(ctx context.Context, s *pacScript, req *Request, resp *Response) error {
+	uri := req.URI()
+	host := string(uri.Host())
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	proxies, err := s.proxiesFor(uri.String(), strings.Trim(host, "[]"))
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, p := range proxies {
+		c.useRequestProxy(proxyPoolKey(&p))
+		err := c.roundTrip(WithProxy(ctx, p), req, resp)
+		var dialErr *proxyDialError
+		if err == nil || ctx.Err() != nil || !errors.As(err, &dialErr) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// pacDNSResolve returns the IP address of host, or null.
+func pacDNSResolve(host string) any {
+	ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+	defer cancel()
+	addr, err := resolveAddr(ctx, "ip", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil
+	}
+	ip, _, _ := net.SplitHostPort(addr)
+	return ip
+}
+
+func pacMyIPAddress() string {
+	// Connecting a UDP socket sends nothing; it only picks the source address.
+	conn, err := net.Dial("udp", "192.0.2.1:9")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func pacIsInNet(host, pattern, mask string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+		defer cancel()
+		addr, err := resolveAddr(ctx, "ip4", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return false
+		}
+		h, _, _ := net.SplitHostPort(addr)
+		ip = net.ParseIP(h)
+	}
+	p, m := net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+	if ip = ip.To4(); ip == nil || p == nil || m == nil {
+		return false
+	}
+	return ip.Mask(net.IPMask(m)).Equal(p.Mask(net.IPMask(m)))
+}
+
+// pacUtils are the PAC functions that don't need Go.
+const pacUtils = `
+function isPlainHostName(host) {
+	return host.indexOf(".") < 0 && host.indexOf(":") < 0;
+}
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) == domain;
+}
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + ".", 0) == 0;
+}
+function isResolvable(host) {
+	return dnsResolve(host) !== null;
+}
+function dnsDomainLevels(host) {
+	return host.split(".").length - 1;
+}
+function convert_addr(ipchars) {
+	var b = ipchars.split(".");
+	return ((b[0] & 0xff) << 24 | (b[1] & 0xff) << 16 | (b[2] & 0xff) << 8 | (b[3] & 0xff)) >>> 0;
+}
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, "\\$&").replace(/\*/g, ".*").replace(/\?/g, ".");
+	return new RegExp("^" + re + "$").test(str);
+}
+
+function pacArgs(args) {
+	var a = Array.prototype.slice.call(args);
+	var gmt = a.length > 0 && a[a.length - 1] === "GMT";
+	if (gmt) {
+		a.pop();
+	}
+	return {args: a, gmt: gmt, now: new Date()};
+}
+function pacInRange(from, to, now) {
+	return from <= to ? from <= now && now <= to : now >= from || now <= to;
+}
+
+var pacWeekdays = ["SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"];
+function weekdayRange() {
+	var a = pacArgs(arguments);
+	var today = a.gmt ? a.now.getUTCDay() : a.now.getDay();
+	var from = pacWeekdays.indexOf(a.args[0]);
+	var to = a.args.length > 1 ? pacWeekdays.indexOf(a.args[1]) : from;
+	return from >= 0 && to >= 0 && pacInRange(from, to, today);
+}
+
+var pacMonths = ["JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"];
+function dateRange() {
+	var a = pacArgs(arguments);
+	var half = Math.ceil(a.args.length / 2);
+	var bounds = [a.args.slice(0, half), a.args.length > 1 ? a.args.slice(half) : a.args];
+	var d = a.now;
+	var now = {
+		y: a.gmt ? d.getUTCFullYear() : d.getFullYear(),
+		m: (a.gmt ? d.getUTCMonth() : d.getMonth()) + 1,
+		d: a.gmt ? d.getUTCDate() : d.getDate()
+	};
+	var fields = {};
+	var values = bounds.map(function (b) {
+		var v = {};
+		b.forEach(function (x) {
+			if (typeof x == "string") {
+				v.m = pacMonths.indexOf(x) + 1;
+			} else if (x > 31) {
+				v.y = x;
+			} else {
+				v.d = x;
+			}
+		});
+		return v;
+	});
+	Object.keys(values[0]).forEach(function (k) { fields[k] = true; });
+	function key(v) {
+		return (fields.y ? v.y * 10000 : 0) + (fields.m ? v.m * 100 : 0) + (fields.d ? v.d : 0);
+	}
+	return pacInRange(key(values[0]), key(values[1]), key(now));
+}
+
+function timeRange() {
+	var a = pacArgs(arguments), n = a.args, d = a.now;
+	var h = a.gmt ? d.getUTCHours() : d.getHours();
+	var m = a.gmt ? d.getUTCMinutes() : d.getMinutes();
+	var s = a.gmt ? d.getUTCSeconds() : d.getSeconds();
+	var now = h * 3600 + m * 60 + s;
+	var from, to;
+	switch (n.length) {
+	case 1:
+		return h == n[0];
+	case 2:
+		from = n[0] * 3600;
+		to = n[1] * 3600;
+		break;
+	case 4:
+		from = n[0] * 3600 + n[1] * 60;
+		to = n[2] * 3600 + n[3] * 60;
+		break;
+	case 6:
+		from = n[0] * 3600 + n[1] * 60 + n[2];
+		to = n[3] * 3600 + n[4] * 60 + n[5];
+		break;
+	default:
+		return false;
+	}
+	return from <= to ? from <= now && now < to : now >= from || now < to;
+}
+`
@@ -0,0 +1,213 @@
+package v2fasthttp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+func TestPACFunctions(t *testing.T) {
+	s, err := newPACScript(`function FindProxyForURL(url, host) { return eval(host); }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expr := range []string{
+		`isPlainHostName("intranet")`,
+		`!isPlainHostName("www.example.com")`,
+		`dnsDomainIs("www.example.com", ".example.com")`,
+		`!dnsDomainIs("www.example.org", ".example.com")`,
+		`localHostOrDomainIs("www", "www.example.com")`,
+		`!localHostOrDomainIs("home", "www.example.com")`,
+		`dnsDomainLevels("www.example.com") == 2`,
+		`shExpMatch("http://a.example.com/x", "*.example.com/*")`,
+		`!shExpMatch("a.example.org", "*.example.com")`,
+		`shExpMatch("a1", "a?")`,
+		`isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0")`,
+		`!isInNet("11.1.2.3", "10.0.0.0", "255.0.0.0")`,
+		`isInNet("localhost", "127.0.0.0", "255.0.0.0")`,
+		`dnsResolve("127.0.0.1") == "127.0.0.1"`,
+		`dnsResolve("no-such-host.invalid") === null`,
+		`isResolvable("localhost")`,
+		`myIpAddress().length > 0`,
+		`convert_addr("1.2.3.4") == 16909060`,
+		`weekdayRange("SUN", "SAT")`,
+		`timeRange(0, 24)`,
+		`dateRange(1, 31)`,
+		`dateRange("JAN", "DEC")`,
+		`dateRange(1, "JAN", 31, "DEC", "GMT")`,
+		`!dateRange(1990, 1991)`,
+	} {
+		// The answer is the expression's value: "true" or "false".
+		got, err := s.evalForTest(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if got != "true" {
+			t.Fatalf("%s = %s", expr, got)
+		}
+	}
+}
+
+// evalForTest runs FindProxyForURL with expr as the host, for scripts that
+// eval it.
+func (s *pacScript) evalForTest(expr string) (string, error) {
+	var result string
+	err := s.run(func() error {
+		v, err := s.find(goja.Undefined(), s.vm.ToValue(""), s.vm.ToValue(expr))
+		if err == nil {
+			result = v.String()
+		}
+		return err
+	})
+	return result, err
+}
+
+func TestParsePACResult(t *testing.T) {
+	got, err := parsePACResult("PROXY a:8080; HTTPS b; SOCKS c:1080;SOCKS5 d:1081; DIRECT; QUIC e:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProxySpec{
+		{Scheme: "http", Addr: "a:8080"},
+		{Scheme: "https", Addr: "b:443"},
+		{Scheme: "socks4", Addr: "c:1080"},
+		{Scheme: "socks5", Addr: "d:1081"},
+		{},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, err := parsePACResult(""); err != nil || len(got) != 1 || got[0].Scheme != "" {
+		t.Fatalf("empty answer: %v, %v", got, err)
+	}
+	if _, err := parsePACResult("PROXY"); err == nil {
+		t.Fatalf("expected an error for a proxy without an address")
+	}
+}
+
+func TestSetProxyPACErrors(t *testing.T) {
+	c := NewClientWithOptions(ClientOptions{HTTPVersion: HTTP2})
+	for _, pac := range []string{
+		"function FindProxyForURL(url, host) {",
+		"function NotFindProxyForURL(url, host) { return 'DIRECT'; }",
+		"http://127.0.0.1:1/proxy.pac",
+	} {
+		if err := c.SetProxyPAC(pac); err == nil {
+			t.Fatalf("%q: expected an error", pac)
+		}
+	}
+
+	old := pacEvalTimeout
+	pacEvalTimeout = 50 * time.Millisecond
+	defer func() { pacEvalTimeout = old }()
+	if err := c.SetProxyPAC("function FindProxyForURL(url, host) { for (;;) {} }"); err != nil {
+		t.Fatalf("SetProxyPAC: %v", err)
+	}
+	start := time.Now()
+	if _, _, err := c.Get(nil, "https://127.0.0.1:1/"); err == nil || !strings.Contains(err.Error(), "PAC script") {
+		t.Fatalf("expected a PAC script error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("the script wasn't interrupted")
+	}
+}
+
+// TestSetProxyPAC routes "localhost" through a stand-in HTTP proxy, falling
+// back to it from an unreachable one, and 127.0.0.1 directly.
+func TestSetProxyPAC(t *testing.T) {
+	versions := []struct {
+		name string
+		opt  ClientOptions
+	}{
+		{"HTTP1", ClientOptions{HTTPVersion: HTTP1}},
+		{"HTTP2", ClientOptions{HTTPVersion: HTTP2}},
+		{"HTTP2NetHTTP", ClientOptions{HTTPVersion: HTTP2, DisableNativeHTTP2: true}},
+	}
+	srv := newTestH2Server(t, protoEchoHandler())
+	viaName := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	for _, v := range versions {
+		for _, fromURL := range []bool{false, true} {
+			name := v.name + "/Script"
+			if fromURL {
+				name = v.name + "/URL"
+			}
+			t.Run(name, func(t *testing.T) {
+				proxy := newTestHTTPProxy(t, false, "")
+				unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				unreachable.Close()
+				script := fmt.Sprintf(`function FindProxyForURL(url, host) {
+	if (host == "localhost" && shExpMatch(url, "https://localhost:*/via-proxy/*")) {
+		return "PROXY %s; PROXY %s";
+	}
+	return "DIRECT";
+}`, unreachable.Addr(), proxy.ln.Addr())
+				pac := script
+				if fromURL {
+					// Served with the test certificate: only the client's
+					// TLS config accepts it.
+					pacSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+						_, _ = w.Write([]byte(script))
+					}))
+					defer pacSrv.Close()
+					pac = pacSrv.URL + "/proxy.pac"
+				}
+
+				opt := v.opt
+				opt.TLSConfig = testClientTLSConfig()
+				c := NewClientWithOptions(opt)
+				defer c.CloseIdleConnections()
+				if err := c.SetProxyPAC(pac); err != nil {
+					t.Fatalf("SetProxyPAC: %v", err)
+				}
+
+				// The script sees each request's URL: the same host goes
+				// direct or through the proxy depending on the path.
+				for _, u := range []string{srv.URL + "/via-proxy/a", viaName + "/direct"} {
+					if _, _, err := c.Get(nil, u); err != nil {
+						t.Fatalf("direct Get %s: %v", u, err)
+					}
+				}
+				if n := proxy.connects.Load(); n != 0 {
+					t.Fatalf("a direct request went through the proxy")
+				}
+				for i := 0; i < 2; i++ {
+					if _, _, err := c.Get(nil, viaName+"/via-proxy/b?q=1"); err != nil {
+						t.Fatalf("proxied Get: %v", err)
+					}
+				}
+				if n := proxy.connects.Load(); n != 1 {
+					t.Fatalf("expected one connection through the proxy, got %d", n)
+				}
+				if _, _, err := c.Get(nil, viaName+"/direct"); err != nil || proxy.connects.Load() != 1 {
+					t.Fatalf("direct Get after the proxied ones: %v, %d connections through the proxy", err, proxy.connects.Load())
+				}
+			})
+		}
+	}
+}
+
+func TestSetProxyPACFetchesThroughClientProxy(t *testing.T) {
+	pacSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`))
+	}))
+	defer pacSrv.Close()
+	proxy := newTestHTTPProxy(t, false, "")
+	c := NewClientWithOptions(ClientOptions{TLSConfig: testClientTLSConfig(), ProxyHTTP: proxy.URL("")})
+	if err := c.SetProxyPAC(pacSrv.URL + "/proxy.pac"); err != nil {
+		t.Fatalf("SetProxyPAC: %v", err)
+	}
+	if proxy.connects.Load() == 0 {
+		t.Fatalf("the PAC file wasn't fetched through the client's proxy")
+	}
+}
@@ -0,0 +1,566 @@
+package v2fasthttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	// ErrNoHealthyClients is returned by a pool whose clients are all
+	// evicted.
+	ErrNoHealthyClients = errors.New("no healthy client in the pool")
+	// ErrPoolClosed is returned by a closed pool.
+	ErrPoolClosed = errors.New("client pool closed")
+)
+
+type ClientPool struct {
+	membersMu sync.Mutex
+	members   atomic.Pointer[[]*PoolMember]
+	healthy   atomic.Pointer[[]*PoolMember]
+	nextID    uint64
+	closed    atomic.Bool
+	selector  Selector
+	failover  atomic.Pointer[FailoverPolicy]
+
+	healthMu sync.Mutex
+	health   atomic.Pointer[poolHealth]
+
+	sessions poolSessions
+}
+
+// ClientPoolOptions configures NewClientPoolWithOptions.
+type ClientPoolOptions struct {
+	Clients []*Client
+	// Selector picks the client of each request. Defaults to
+	// NewRoundRobinSelector().
+	Selector Selector
+	// SessionTTL is how long a Session stays on its client without
+	// requests. Defaults to 10 minutes.
+	SessionTTL time.Duration
+	// Failover, if set, retries failed requests on other clients.
+	Failover *FailoverPolicy
+}
+
+// PoolMember is a client of a ClientPool along with the load and latency
+// figures selectors go by.
+type PoolMember struct {
+	client  *Client
+	id      uint64
+	evicted atomic.Bool
+	removed atomic.Bool
+
+	inFlight atomic.Int64
+	// latency is the EWMA of the request latencies, in nanoseconds.
+	latency atomic.Int64
+	// weight and current are the state of the weighted selector.
+	weight  atomic.Int64
+	current int64
+
+	mu        sync.Mutex
+	failures  int
+	lastErr   error
+	lastCheck time.Time
+}
+
+// Client returns the member's client.
+func (m *PoolMember) Client() *Client { return m.client }
+
+// InFlight returns the number of requests the pool has under way on the
+// member.
+func (m *PoolMember) InFlight() int { return int(m.inFlight.Load()) }
+
+// Latency returns the moving average of the member's request latencies, or
+// 0 before its first request completes.
+func (m *PoolMember) Latency() time.Duration { return time.Duration(m.latency.Load()) }
+
+const (
+	// latencyDecay is the weight of the past in the latency average.
+	latencyDecay = 0.8
+	// failureLatency is the least latency a failed request counts for, so
+	// that a client failing fast doesn't look fast.
+	failureLatency = time.Second
+)
+
+func (m *PoolMember) observe(d time.Duration, err error) {
+	if err != nil && d < failureLatency {
+		d = failureLatency
+	}
+	for {
+		old := m.latency.Load()
+		v := int64(d)
+		if old != 0 {
+			v = int64(latencyDecay*float64(old) + (1-latencyDecay)*float64(d))
+		}
+		if m.latency.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+func newClientPool(clients []*Client, selector Selector) *ClientPool {
+	if selector == nil {
+		selector = NewRoundRobinSelector()
+	}
+	p := &ClientPool{selector: selector}
+	p.membersMu.Lock()
+	defer p.membersMu.Unlock()
+	members := make([]*PoolMember, len(clients))
+	for i, c := range clients {
+		members[i] = p.newMember(c)
+	}
+	p.setMembersLocked(members)
+	return p
+}
+
+func (p *ClientPool) newMember(c *Client) *PoolMember {
+	m := &PoolMember{client: c, id: p.nextID}
+	p.nextID++
+	return m
+}
+
+func NewClientPool(size int, factory func() *Client) *ClientPool {
+	if size <= 0 {
+		size = 1
+	}
+	clients := make([]*Client, size)
+	for i := 0; i < size; i++ {
+		c := factory()
+		if c == nil {
+			c = &Client{}
+		}
+		clients[i] = c
+	}
+	return newClientPool(clients, nil)
+}
+
+// NewClientPoolWithOptions returns a pool of opt.Clients.
+func NewClientPoolWithOptions(opt ClientPoolOptions) *ClientPool {
+	clients := make([]*Client, 0, len(opt.Clients))
+	for _, c := range opt.Clients {
+		if c != nil {
+			clients = append(clients, c)
+		}
+	}
+	p := newClientPool(clients, opt.Selector)
+	p.SetSessionTTL(opt.SessionTTL)
+	p.SetFailover(opt.Failover)
+	return p
+}
+
+// memberList returns the current members. The slice is never modified.
+func (p *ClientPool) memberList() []*PoolMember {
+	if p == nil {
+		return nil
+	}
+	return *p.members.Load()
+}
+
+func (p *ClientPool) setMembersLocked(members []*PoolMember) {
+	p.members.Store(&members)
+	p.updateHealthyLocked()
+}
+
+// updateHealthy refreshes the list of members selectors choose from. It
+// runs whenever a member is evicted, reinstated, added or removed.
+func (p *ClientPool) updateHealthy() {
+	p.membersMu.Lock()
+	defer p.membersMu.Unlock()
+	p.updateHealthyLocked()
+}
+
+func (p *ClientPool) updateHealthyLocked() {
+	members := p.memberList()
+	healthy := make([]*PoolMember, 0, len(members))
+	for _, m := range members {
+		if !m.evicted.Load() {
+			healthy = append(healthy, m)
+		}
+	}
+	p.healthy.Store(&healthy)
+}
+
+func (p *ClientPool) setEvicted(m *PoolMember, evicted bool) {
+	if m.evicted.Swap(evicted) != evicted {
+		p.updateHealthy()
+	}
+}
+
+// Next returns the client the pool's selector picks, skipping the evicted
+// ones, or nil if there is none. Requests made with it directly don't count
+// towards the load and latency figures of the pool.
+func (p *ClientPool) Next() *Client {
+	m := p.next(nil)
+	if m == nil {
+		return nil
+	}
+	return m.client
+}
+
+func (p *ClientPool) next(req *Request) *PoolMember {
+	if p == nil || p.closed.Load() {
+		return nil
+	}
+	healthy := *p.healthy.Load()
+	if len(healthy) == 0 {
+		return nil
+	}
+	return p.selector.Select(req, healthy)
+}
+
+func (p *ClientPool) Do(req *Request, resp *Response) error {
+	return p.do(context.Background(), req, resp, func(c *Client) error { return c.Do(req, resp) })
+}
+
+func (p *ClientPool) DoCtx(ctx context.Context, req *Request, resp *Response) error {
+	return p.do(ctx, req, resp, func(c *Client) error { return c.DoCtx(ctx, req, resp) })
+}
+
+func (p *ClientPool) do(ctx context.Context, req *Request, resp *Response, do func(*Client) error) error {
+	m := p.next(req)
+	if m == nil {
+		return p.noClientError()
+	}
+	if f := p.failover.Load(); f.retries(req) {
+		return p.doFailover(ctx, f, m, req, resp, do)
+	}
+	return p.doMember(ctx, m, resp, do)
+}
+
+func (p *ClientPool) doMember(ctx context.Context, m *PoolMember, resp *Response, do func(*Client) error) error {
+	m.inFlight.Add(1)
+	start := time.Now()
+	err := do(m.client)
+	m.inFlight.Add(-1)
+	p.report(ctx, m, time.Since(start), err, resp)
+	return err
+}
+
+func (p *ClientPool) noClientError() error {
+	switch {
+	case p == nil:
+		return fasthttp.ErrNoFreeConns
+	case p.closed.Load():
+		return ErrPoolClosed
+	case len(p.memberList()) == 0:
+		return fasthttp.ErrNoFreeConns
+	}
+	return ErrNoHealthyClients
+}
+
+// Len returns the number of clients in the pool, evicted ones included.
+func (p *ClientPool) Len() int {
+	return len(p.memberList())
+}
+
+// Add adds clients to the pool.
+func (p *ClientPool) Add(clients ...*Client) error {
+	p.membersMu.Lock()
+	defer p.membersMu.Unlock()
+	if p.closed.Load() {
+		return ErrPoolClosed
+	}
+	members := slices.Clone(p.memberList())
+	for _, c := range clients {
+		if c != nil {
+			members = append(members, p.newMember(c))
+		}
+	}
+	p.setMembersLocked(members)
+	return nil
+}
+
+// Remove takes c out of the pool and closes its idle connections. Its
+// requests under way carry on. It returns false if c isn't in the pool.
+func (p *ClientPool) Remove(c *Client) bool {
+	p.membersMu.Lock()
+	defer p.membersMu.Unlock()
+	members := p.memberList()
+	i := slices.IndexFunc(members, func(m *PoolMember) bool { return m.client == c })
+	if i < 0 {
+		return false
+	}
+	members[i].removed.Store(true)
+	p.setMembersLocked(slices.Delete(slices.Clone(members), i, i+1))
+	c.CloseIdleConnections()
+	return true
+}
+
+// Replace makes clients the members of the pool. Clients already in the
+// pool keep their health, figures and sessions; the others are removed as
+// by Remove.
+func (p *ClientPool) Replace(clients ...*Client) error {
+	p.membersMu.Lock()
+	defer p.membersMu.Unlock()
+	if p.closed.Load() {
+		return ErrPoolClosed
+	}
+	old := slices.Clone(p.memberList())
+	members := make([]*PoolMember, 0, len(clients))
+	for _, c := range clients {
+		if c == nil {
+			continue
+		}
+		if i := slices.IndexFunc(old, func(m *PoolMember) bool { return m != nil && m.client == c }); i >= 0 {
+			members = append(members, old[i])
+			old[i] = nil
+		} else {
+			members = append(members, p.newMember(c))
+		}
+	}
+	p.setMembersLocked(members)
+	for _, m := range old {
+		if m != nil {
+			m.removed.Store(true)
+			m.client.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// Close stops the health checks and closes the idle connections of every
+// client. The requests under way carry on, but new ones fail with
+// ErrPoolClosed.
+func (p *ClientPool) Close() {
+	if p == nil || p.closed.Swap(true) {
+		return
+	}
+	p.healthMu.Lock()
+	p.stopHealthChecksLocked()
+	p.healthMu.Unlock()
+	for _, m := range p.memberList() {
+		m.client.CloseIdleConnections()
+	}
+}
+
+// HealthCheckOptions configures the health checks of a ClientPool.
+type HealthCheckOptions struct {
+	// CheckURL is requested through evicted clients to find out when they
+	// have recovered.
+	CheckURL string
+	// MaxFailures is the number of consecutive failures (transport errors,
+	// the client's own timeouts and 407 Proxy Authentication Required
+	// responses) that evicts a client. Requests cut short by the caller's
+	// context don't count. Defaults to 3.
+	MaxFailures int
+	// Interval is the time between probes of evicted clients. Defaults to
+	// 10s.
+	Interval time.Duration
+	// Timeout bounds each probe. Defaults to 5s.
+	Timeout time.Duration
+}
+
+// ClientHealth is the health of a pool client.
+type ClientHealth struct {
+	// Proxy is the client's proxy (password redacted), or "" if it has none.
+	Proxy   string
+	Healthy bool
+	// Failures counts the consecutive failed requests and probes.
+	Failures  int
+	LastError error
+	// LastCheck is the time of the last probe, or zero.
+	LastCheck time.Time
+}
+
+type poolHealth struct {
+	opt  HealthCheckOptions
+	stop chan struct{}
+	done chan struct{}
+}
+
+// EnableHealthChecks makes the pool evict clients that keep failing and
+// probe them in the background, putting them back in rotation once a probe
+// succeeds: the check URL answers with a status below 500 other than 407.
+func (p *ClientPool) EnableHealthChecks(opt HealthCheckOptions) error {
+	if p == nil {
+		return nil
+	}
+	if opt.CheckURL == "" {
+		return errors.New("health checks need a CheckURL")
+	}
+	if opt.MaxFailures <= 0 {
+		opt.MaxFailures = 3
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = 10 * time.Second
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 5 * time.Second
+	}
+
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	if p.closed.Load() {
+		return ErrPoolClosed
+	}
+	p.stopHealthChecksLocked()
+	h := &poolHealth{opt: opt, stop: make(chan struct{}), done: make(chan struct{})}
+	p.health.Store(h)
+	go p.probeLoop(h)
+	return nil
+}
+
+// StopHealthChecks stops the health checks and puts every client back in
+// rotation.
+func (p *ClientPool) StopHealthChecks() {
+	if p == nil {
+		return
+	}
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.stopHealthChecksLocked()
+	for _, m := range p.memberList() {
+		m.mu.Lock()
+		m.failures, m.lastErr = 0, nil
+		m.evicted.Store(false)
+		m.mu.Unlock()
+	}
+	p.updateHealthy()
+}
+
+func (p *ClientPool) stopHealthChecksLocked() {
+	h := p.health.Swap(nil)
+	if h == nil {
+		return
+	}
+	close(h.stop)
+	<-h.done
+}
+
+// Health returns the health of every client, in pool order.
+func (p *ClientPool) Health() []ClientHealth {
+	if p == nil {
+		return nil
+	}
+	members := p.memberList()
+	health := make([]ClientHealth, len(members))
+	for i, m := range members {
+		m.mu.Lock()
+		health[i] = ClientHealth{
+			Healthy:   !m.evicted.Load(),
+			Failures:  m.failures,
+			LastError: m.lastErr,
+			LastCheck: m.lastCheck,
+		}
+		m.mu.Unlock()
+		health[i].Proxy = clientProxyName(m.client)
+	}
+	return health
+}
+
+func clientProxyName(c *Client) string {
+	if proxy, ok := c.CurrentProxy(); ok {
+		return proxy.String()
+	}
+	return ""
+}
+
+// report records the outcome of a request made through m with ctx. A
+// request that failed once ctx was done, be it cancelled or past the
+// caller's deadline, says nothing about m and isn't counted.
+func (p *ClientPool) report(ctx context.Context, m *PoolMember, d time.Duration, err error, resp *Response) {
+	if err != nil && ctxDone(ctx) != nil {
+		return
+	}
+	if !errors.Is(err, context.Canceled) {
+		m.observe(d, err)
+	}
+	h := p.health.Load()
+	if h == nil {
+		return
+	}
+	if err == nil && resp.StatusCode() == fasthttp.StatusProxyAuthRequired {
+		err = errProxyAuthRequired
+	}
+	if !isClientFailure(err) {
+		m.mu.Lock()
+		m.failures, m.lastErr = 0, nil
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Lock()
+	m.failures++
+	m.lastErr = err
+	evict := m.failures >= h.opt.MaxFailures
+	m.mu.Unlock()
+	if evict {
+		p.setEvicted(m, true)
+	}
+}
+
+var errProxyAuthRequired = fmt.Errorf("status %d: proxy authentication required", fasthttp.StatusProxyAuthRequired)
+
+// isClientFailure reports whether err says more about the client (its proxy
+// or network path) than about the request.
+func isClientFailure(err error) bool {
+	return err != nil &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, fasthttp.ErrBodyTooLarge)
+}
+
+func (p *ClientPool) probeLoop(h *poolHealth) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.opt.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, m := range p.memberList() {
+			if m.evicted.Load() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p.probe(h, m)
+				}()
+			}
+		}
+		wg.Wait()
+	}
+}
+
+// probe requests the check URL through the evicted member m and puts it back
+// in rotation if that works.
+func (p *ClientPool) probe(h *poolHealth, m *PoolMember) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.opt.Timeout)
+	defer cancel()
+	go func() {
+		// Stopping the checks abandons the probe.
+		select {
+		case <-h.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(h.opt.CheckURL)
+	err := m.client.DoCtx(ctx, req, resp)
+	if err == nil && (resp.StatusCode() >= 500 || resp.StatusCode() == fasthttp.StatusProxyAuthRequired) {
+		err = fmt.Errorf("health check: status %d", resp.StatusCode())
+	}
+
+	m.mu.Lock()
+	m.lastCheck = time.Now()
+	if err != nil {
+		m.failures++
+		m.lastErr = err
+		m.mu.Unlock()
+		return
+	}
+	m.failures, m.lastErr = 0, nil
+	m.mu.Unlock()
+	p.setEvicted(m, false)
+}
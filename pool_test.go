@@ -0,0 +1,224 @@
+package v2fasthttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TestClientPoolHealthChecks takes a stand-in proxy down until the pool
+// evicts it, then brings it back up until a probe reinstates it.
+func TestClientPoolHealthChecks(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	a := newTestHTTPProxy(t, false, "")
+	b := newTestHTTPProxy(t, false, "")
+	pool := NewProxyClientPool([]string{a.URL(""), b.URL("")}, 1)
+	if err := pool.EnableHealthChecks(HealthCheckOptions{
+		CheckURL:    srv.URL + "/",
+		MaxFailures: 2,
+		Interval:    20 * time.Millisecond,
+	}); err != nil {
+		t.Fatalf("EnableHealthChecks: %v", err)
+	}
+	defer pool.StopHealthChecks()
+
+	a.down.Store(true)
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	failures := 0
+	for i := 0; i < 10; i++ {
+		if err := pool.Do(&req, &resp); err != nil {
+			failures++
+		}
+	}
+	if failures != 2 {
+		t.Fatalf("expected 2 failures before the eviction, got %d", failures)
+	}
+	h := pool.Health()
+	if h[0].Healthy || h[0].LastError == nil || h[0].Proxy != a.URL("") || !h[1].Healthy {
+		t.Fatalf("unexpected health: %+v", h)
+	}
+
+	a.down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for !pool.Health()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("the proxy wasn't reinstated: %+v", pool.Health())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h := pool.Health()[0]; h.Failures != 0 || h.LastError != nil || h.LastCheck.IsZero() {
+		t.Fatalf("unexpected health after reinstatement: %+v", h)
+	}
+	before := a.connects.Load()
+	for i := 0; i < 4; i++ {
+		if err := pool.Do(&req, &resp); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+	}
+	if a.connects.Load() == before {
+		t.Fatalf("the reinstated proxy got no requests")
+	}
+}
+
+func TestClientPoolEvictsOnProxyAuthRequired(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	proxy := newTestHTTPProxy(t, false, "user:pass")
+	pool := NewProxyClientPool([]string{proxy.URL("user:wrong")}, 1)
+	if err := pool.EnableHealthChecks(HealthCheckOptions{CheckURL: srv.URL + "/", MaxFailures: 1, Interval: time.Hour}); err != nil {
+		t.Fatalf("EnableHealthChecks: %v", err)
+	}
+	defer pool.StopHealthChecks()
+
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	_ = pool.Do(&req, &resp)
+	if h := pool.Health()[0]; h.Healthy || h.LastError == nil {
+		t.Fatalf("expected the proxy to be evicted, got %+v", h)
+	}
+	if err := pool.Do(&req, &resp); !errors.Is(err, ErrNoHealthyClients) {
+		t.Fatalf("expected ErrNoHealthyClients, got %v", err)
+	}
+
+	pool.StopHealthChecks()
+	if h := pool.Health()[0]; !h.Healthy || h.Failures != 0 {
+		t.Fatalf("StopHealthChecks didn't reinstate the proxy: %+v", h)
+	}
+	if err := pool.EnableHealthChecks(HealthCheckOptions{}); err == nil {
+		t.Fatalf("expected an error without a CheckURL")
+	}
+}
+
+// TestClientPoolIgnoresCallerDeadlines checks that requests cut short by
+// the caller's own deadline don't evict a healthy member.
+func TestClientPoolIgnoresCallerDeadlines(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	pool := NewClientPoolWithOptions(ClientPoolOptions{Clients: []*Client{NewClientWithOptions(ClientOptions{})}})
+	defer pool.Close()
+	if err := pool.EnableHealthChecks(HealthCheckOptions{CheckURL: srv.URL + "/", MaxFailures: 2, Interval: time.Hour}); err != nil {
+		t.Fatalf("EnableHealthChecks: %v", err)
+	}
+	defer pool.StopHealthChecks()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		var req Request
+		var resp Response
+		req.SetRequestURI(srv.URL + "/")
+		err := pool.DoCtx(ctx, &req, &resp)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the caller's deadline to expire, got %v", err)
+		}
+	}
+	if h := pool.Health()[0]; !h.Healthy || h.Failures != 0 {
+		t.Fatalf("the caller's deadlines counted against the member: %+v", h)
+	}
+}
+
+func TestClientPoolMembership(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	a := newTestHTTPProxy(t, false, "")
+	b := newTestHTTPProxy(t, false, "")
+	ca, cb := NewHighPerfClient(a.URL("")), NewHighPerfClient(b.URL(""))
+	pool := NewClientPoolWithOptions(ClientPoolOptions{})
+
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	if err := pool.Do(&req, &resp); !errors.Is(err, fasthttp.ErrNoFreeConns) {
+		t.Fatalf("expected ErrNoFreeConns from an empty pool, got %v", err)
+	}
+	if err := pool.Add(ca); err != nil || pool.Len() != 1 {
+		t.Fatalf("Add: %v, Len %d", err, pool.Len())
+	}
+	s := pool.Session("s")
+	if err := s.Do(&req, &resp); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	// Swapping the proxy list moves the session and the new requests over.
+	if err := pool.Replace(cb); err != nil || pool.Len() != 1 {
+		t.Fatalf("Replace: %v, Len %d", err, pool.Len())
+	}
+	if s.Client() != cb {
+		t.Fatalf("the session stayed on a removed client")
+	}
+	before := a.connects.Load()
+	for i := 0; i < 3; i++ {
+		if err := pool.Do(&req, &resp); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+	}
+	if a.connects.Load() != before || b.connects.Load() == 0 {
+		t.Fatalf("requests didn't move to the new proxy: %d, %d", a.connects.Load(), b.connects.Load())
+	}
+	if pool.Remove(ca) {
+		t.Fatalf("removed a client that isn't in the pool")
+	}
+	_ = pool.Add(ca)
+	if !pool.Remove(cb) || pool.Len() != 1 || pool.Next() != ca {
+		t.Fatalf("Remove didn't take the client out")
+	}
+
+	pool.Close()
+	if err := pool.Do(&req, &resp); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+	if err := pool.Add(cb); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Add after Close: %v", err)
+	}
+}
+
+// TestClientPoolReplaceUnderLoad swaps members while requests are under
+// way: none may fail.
+func TestClientPoolReplaceUnderLoad(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	proxies := []*testHTTPProxy{newTestHTTPProxy(t, false, ""), newTestHTTPProxy(t, false, "")}
+	clients := []*Client{NewHighPerfClient(proxies[0].URL("")), NewHighPerfClient(proxies[1].URL(""))}
+	pool := NewClientPoolWithOptions(ClientPoolOptions{Clients: clients[:1], Selector: NewLeastInFlightSelector()})
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var req Request
+			var resp Response
+			req.SetRequestURI(srv.URL + "/")
+			for i := 0; i < 25; i++ {
+				if err := pool.Do(&req, &resp); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		_ = pool.Replace(clients[i%2])
+		if i%3 == 0 {
+			_ = pool.Add(clients[(i+1)%2])
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("request failed during Replace: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ProxyRule sends the connections to matching targets through Proxy.
+type ProxyRule struct {
+	// Hosts are host name patterns, matched case-insensitively: "*" matches
+	// any run of characters, so "*.internal" matches "a.internal" and
+	// "a.b.internal" but not "internal", while ".internal" matches
+	// "internal" and every name under it, as in NO_PROXY. "*" alone matches
+	// every host.
+	Hosts []string
+	// CIDRs match targets given as IP addresses ("10.0.0.0/8", or a single
+	// address). Host names aren't resolved to be matched.
+	CIDRs []string
+	// Ports, if set, limit the rule to these target ports.
+	Ports []int
+	// Proxy is the proxy URL, of any scheme ParseProxy accepts but masque.
+	// An empty Proxy, or "direct", connects directly.
+	Proxy string
+}
+
+// ProxyRules picks the proxy of each connection from its target: the first
+// matching rule decides, and targets no rule matches use the default proxy.
+type ProxyRules struct {
+	rules []proxyRule
+	def   *ProxySpec
+}
+
+type proxyRule struct {
+	hosts []string
+	nets  []*net.IPNet
+	ports []string
+	// proxy is nil for direct connections.
+	proxy *ProxySpec
+}
+
+// NewProxyRules returns the rules, checked in order, with defaultProxy for
+// the targets none of them match ("" or "direct" to connect directly).
+func NewProxyRules(defaultProxy string, rules ...ProxyRule) (*ProxyRules, error) {
+	def, err := parseRuleProxy(defaultProxy)
+	if err != nil {
+		return nil, fmt.Errorf("default proxy: %w", err)
+	}
+	r := &ProxyRules{def: def}
+	for i, rule := range rules {
+		pr := proxyRule{}
+		if pr.proxy, err = parseRuleProxy(rule.Proxy); err != nil {
+			return nil, fmt.Errorf("proxy rule %d: %w", i, err)
+		}
+		for _, host := range rule.Hosts {
+			host = strings.TrimSuffix(strings.ToLower(host), ".")
+			if _, err := path.Match(host, ""); err != nil || host == "" {
+				return nil, fmt.Errorf("proxy rule %d: bad host pattern %q", i, host)
+			}
+			pr.hosts = append(pr.hosts, host)
+		}
+		for _, cidr := range rule.CIDRs {
+			if !strings.Contains(cidr, "/") {
+				if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("proxy rule %d: %w", i, err)
+			}
+			pr.nets = append(pr.nets, ipNet)
+		}
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("proxy rule %d: bad port %d", i, port)
+			}
+			pr.ports = append(pr.ports, strconv.Itoa(port))
+		}
+		r.rules = append(r.rules, pr)
+	}
+	return r, nil
+}
+
+func parseRuleProxy(proxy string) (*ProxySpec, error) {
+	if proxy == "" || strings.EqualFold(proxy, "direct") {
+		return nil, nil
+	}
+	p, err := ParseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if p.Scheme == "masque" {
+		return nil, fmt.Errorf("proxy %s: MASQUE proxies can't carry TCP", p)
+	}
+	return &p, nil
+}
+
+// ProxyFor returns the proxy for connections to addr (host:port), or false
+// if they are direct.
+func (r *ProxyRules) ProxyFor(addr string) (ProxySpec, bool) {
+	if p := r.match(addr); p != nil {
+		return *p, true
+	}
+	return ProxySpec{}, false
+}
+
+func (r *ProxyRules) match(addr string) *ProxySpec {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for i := range r.rules {
+		if r.rules[i].matches(host, port) {
+			return r.rules[i].proxy
+		}
+	}
+	return r.def
+}
+
+func (pr *proxyRule) matches(host, port string) bool {
+	if len(pr.ports) > 0 && !slices.Contains(pr.ports, port) {
+		return false
+	}
+	if len(pr.hosts) == 0 && len(pr.nets) == 0 {
+		return true
+	}
+	for _, pattern := range pr.hosts {
+		if domain, ok := strings.CutPrefix(pattern, "."); ok {
+			if host == domain || strings.HasSuffix(host, pattern) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range pr.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialer returns the TCP dialer that follows the rules.
+func (r *ProxyRules) dialer(forward dialContextFunc, tlsConfig *tls.Config) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		p := r.match(addr)
+		if p == nil {
+			return forward(ctx, network, addr)
+		}
+		dial, err := p.dialer(forward, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// netHTTPProxy is the net/http Transport.Proxy of the rules: it hands
+// HTTP(S) proxies to net/http and leaves the others to netHTTPDialer.
+func (r *ProxyRules) netHTTPProxy(req *http.Request) (*url.URL, error) {
+	if p := r.match(canonicalAddr(req.URL)); p != nil && (p.Scheme == "http" || p.Scheme == "https") {
+		return p.URL(), nil
+	}
+	return nil, nil
+}
+
+// netHTTPDialer is the net/http Transport.DialContext of the rules. net/http
+// dials HTTP(S) proxies itself, so their addresses are reached directly.
+func (r *ProxyRules) netHTTPDialer(forward dialContextFunc, tlsConfig *tls.Config) dialContextFunc {
+	httpProxies := make(map[string]bool)
+	for _, p := range append([]*ProxySpec{r.def}, r.proxies()...) {
+		if p != nil && (p.Scheme == "http" || p.Scheme == "https") {
+			httpProxies[p.Addr] = true
+		}
+	}
+	dial := r.dialer(forward, tlsConfig)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if httpProxies[addr] {
+			return forward(ctx, network, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+func (r *ProxyRules) proxies() []*ProxySpec {
+	proxies := make([]*ProxySpec, len(r.rules))
+	for i := range r.rules {
+		proxies[i] = r.rules[i].proxy
+	}
+	return proxies
+}
+
+// canonicalAddr returns the host:port of u, with the scheme's default port.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
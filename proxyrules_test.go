@@ -0,0 +1,181 @@
+package v2fasthttp
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProxyRulesMatching(t *testing.T) {
+	rules, err := NewProxyRules("socks5://default:1080",
+		ProxyRule{Hosts: []string{"*.internal"}, Proxy: "direct"},
+		ProxyRule{Hosts: []string{".corp.example"}, Ports: []int{443}, Proxy: "http://corp:3128"},
+		ProxyRule{Hosts: []string{"Exact.Example.com"}, Proxy: "socks4a://exact"},
+		ProxyRule{CIDRs: []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"}},
+		ProxyRule{Ports: []int{8443}, Proxy: "https://tls-proxy"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr  string
+		proxy string // "" for direct
+	}{
+		{"a.internal:443", ""},
+		{"a.b.internal:80", ""},
+		{"internal:80", "socks5://default:1080"},
+		{"corp.example:443", "http://corp:3128"},
+		{"WWW.corp.example.:443", "http://corp:3128"},
+		{"www.corp.example:80", "socks5://default:1080"},
+		{"notcorp.example:443", "socks5://default:1080"},
+		{"exact.example.com:443", "socks4a://exact:1080"},
+		{"sub.exact.example.com:443", "socks5://default:1080"},
+		{"10.1.2.3:80", ""},
+		{"11.1.2.3:80", "socks5://default:1080"},
+		{"192.168.1.10:80", ""},
+		{"192.168.1.11:80", "socks5://default:1080"},
+		{"[fd00::1]:443", ""},
+		{"a.internal:8443", ""},
+		{"example.com:8443", "https://tls-proxy:443"},
+	}
+	for _, tt := range tests {
+		p, ok := rules.ProxyFor(tt.addr)
+		var got string
+		if ok {
+			got = p.String()
+		}
+		if got != tt.proxy {
+			t.Errorf("ProxyFor(%q) = %q, want %q", tt.addr, got, tt.proxy)
+		}
+	}
+
+	direct, err := NewProxyRules("", ProxyRule{Hosts: []string{"*"}, Ports: []int{80}, Proxy: "http://p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := direct.ProxyFor("example.com:443"); ok {
+		t.Fatalf("expected a direct connection by default")
+	}
+	if _, ok := direct.ProxyFor("example.com:80"); !ok {
+		t.Fatalf("expected the proxy for port 80")
+	}
+}
+
+func TestNewProxyRulesErrors(t *testing.T) {
+	for _, rule := range []ProxyRule{
+		{Hosts: []string{"[a-"}},
+		{Hosts: []string{""}},
+		{CIDRs: []string{"10.0.0.0/33"}},
+		{CIDRs: []string{"not-an-ip"}},
+		{Ports: []int{0}},
+		{Proxy: "ftp://proxy"},
+		{Proxy: "masque://proxy"},
+	} {
+		if _, err := NewProxyRules("", rule); err == nil {
+			t.Errorf("%+v: expected an error", rule)
+		}
+	}
+	if _, err := NewProxyRules("gopher://proxy"); err == nil {
+		t.Errorf("expected an error for the default proxy")
+	}
+}
+
+// TestSetProxyRules sends requests to two local servers: by name through an
+// HTTP proxy, and by address through a default SOCKS5 proxy except for the
+// second server's port, which is direct.
+func TestSetProxyRules(t *testing.T) {
+	versions := []struct {
+		name string
+		opt  ClientOptions
+	}{
+		{"HTTP1", ClientOptions{HTTPVersion: HTTP1}},
+		{"HTTP2", ClientOptions{HTTPVersion: HTTP2}},
+		{"HTTP2NetHTTP", ClientOptions{HTTPVersion: HTTP2, DisableNativeHTTP2: true}},
+	}
+	srvA := newTestH2Server(t, protoEchoHandler())
+	srvB := newTestH2Server(t, protoEchoHandler())
+	u, _ := url.Parse(srvB.URL)
+	portB, _ := strconv.Atoi(u.Port())
+
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			httpProxy := newTestHTTPProxy(t, false, "")
+			socks := newTestSOCKS5Server(t, false)
+			rules, err := NewProxyRules(socks.URL(),
+				ProxyRule{Hosts: []string{"localhost"}, Proxy: httpProxy.URL("")},
+				ProxyRule{CIDRs: []string{"127.0.0.0/8"}, Ports: []int{portB}, Proxy: "direct"},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opt := v.opt
+			opt.TLSConfig = testClientTLSConfig()
+			c := NewClientWithOptions(opt)
+			defer c.CloseIdleConnections()
+			c.SetProxyRules(rules)
+
+			get := func(url string) {
+				t.Helper()
+				if status, _, err := c.Get(nil, url); err != nil || status != 200 {
+					t.Fatalf("Get %s: status %d, err %v", url, status, err)
+				}
+			}
+			get(srvB.URL)
+			if httpProxy.connects.Load() != 0 || socks.connects.Load() != 0 {
+				t.Fatalf("the direct rule went through a proxy")
+			}
+			get(srvA.URL)
+			if socks.connects.Load() == 0 {
+				t.Fatalf("the default proxy wasn't used")
+			}
+			get(strings.Replace(srvA.URL, "127.0.0.1", "localhost", 1))
+			if httpProxy.connects.Load() == 0 {
+				t.Fatalf("the host rule's proxy wasn't used")
+			}
+		})
+	}
+}
+
+// TestSetProxyRulesDowngradesHTTP3 checks that rules replace an earlier
+// SOCKS5 proxy for QUIC too: HTTP3 requests go over HTTP/2 as the rules
+// say, and no datagram reaches the old proxy.
+func TestSetProxyRulesDowngradesHTTP3(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	socks := newTestSOCKS5Server(t, false)
+	httpProxy := newTestHTTPProxy(t, false, "")
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP3,
+		TLSConfig:   testClientTLSConfig(),
+		SOCKS5Proxy: socks.URL(),
+	})
+	defer c.CloseIdleConnections()
+	rules, err := NewProxyRules(httpProxy.URL(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetProxyRules(rules)
+
+	if body, info := doWithInfo(t, c, srv.URL); body != "HTTP/2.0" || !info.Downgraded {
+		t.Fatalf("body %q, info %+v", body, info)
+	}
+	if socks.associates.Load() != 0 || socks.datagrams.Load() != 0 || socks.connects.Load() != 0 {
+		t.Fatalf("QUIC still went through the old SOCKS5 proxy")
+	}
+	if httpProxy.connects.Load() == 0 {
+		t.Fatalf("the request didn't go where the rules say")
+	}
+	if err := c.HTTP3Downgrade(); !errors.Is(err, ErrProxyUDPUnsupported) {
+		t.Fatalf("expected a downgrade, got %v", err)
+	}
+
+	c.ClearProxy()
+	if err := c.HTTP3Downgrade(); err != nil {
+		t.Fatalf("ClearProxy kept the downgrade: %v", err)
+	}
+	c.SetProxyFromEnvironment()
+	if err := c.HTTP3Downgrade(); !errors.Is(err, ErrProxyUDPUnsupported) {
+		t.Fatalf("expected a downgrade with environment proxies, got %v", err)
+	}
+}
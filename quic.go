@@ -0,0 +1,94 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3Options tunes the QUIC connections of HTTP3 and HTTPAuto clients.
+// Zero values keep quic-go's defaults.
+type HTTP3Options struct {
+	// MaxIdleTimeout defaults to ClientOptions.MaxIdleConnDuration.
+	MaxIdleTimeout                 time.Duration
+	KeepAlivePeriod                time.Duration
+	MaxIncomingStreams             int64
+	InitialStreamReceiveWindow     uint64
+	MaxStreamReceiveWindow         uint64
+	InitialConnectionReceiveWindow uint64
+	MaxConnectionReceiveWindow     uint64
+	// Enable0RTT resumes TLS sessions and sends GET and HEAD requests
+	// without a body as 0-RTT data. 0-RTT data can be replayed.
+	Enable0RTT bool
+	// EnableDatagrams negotiates HTTP Datagrams (RFC 9297).
+	EnableDatagrams bool
+	// PacketConn carries all direct QUIC connections instead of a new UDP
+	// socket per connection. It is not closed by the client.
+	PacketConn net.PacketConn
+}
+
+type quicDialFunc func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error)
+
+func newQUICConfig(opt ClientOptions) *quic.Config {
+	h3 := opt.HTTP3Options
+	cfg := &quic.Config{
+		MaxIdleTimeout:                 h3.MaxIdleTimeout,
+		KeepAlivePeriod:                h3.KeepAlivePeriod,
+		MaxIncomingStreams:             h3.MaxIncomingStreams,
+		InitialStreamReceiveWindow:     h3.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         h3.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: h3.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     h3.MaxConnectionReceiveWindow,
+		EnableDatagrams:                h3.EnableDatagrams,
+	}
+	if cfg.MaxIdleTimeout == 0 {
+		cfg.MaxIdleTimeout = opt.MaxIdleConnDuration
+	}
+	return cfg
+}
+
+func newH3TLSConfig(opt ClientOptions) *tls.Config {
+	if !opt.HTTP3Options.Enable0RTT {
+		return opt.TLSConfig
+	}
+	cfg := &tls.Config{}
+	if opt.TLSConfig != nil {
+		cfg = opt.TLSConfig.Clone()
+	}
+	if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return cfg
+}
+
+// dialQUIC dials a direct QUIC connection, over HTTP3Options.PacketConn if
+// one was given.
+func (c *Client) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	tlsCfg, cfg = sessionsThrough(tlsCfg, nil), tokensThrough(cfg, nil)
+	if c.quicTransport == nil {
+		return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.quicTransport.DialEarly(ctx, udpAddr, tlsCfg, cfg)
+}
+
+// use0RTT lets http3 send idempotent requests before the handshake is done.
+func use0RTT(httpReq *http.Request) {
+	if httpReq.Body != nil && httpReq.Body != http.NoBody {
+		return
+	}
+	switch httpReq.Method {
+	case http.MethodGet:
+		httpReq.Method = http3.MethodGet0RTT
+	case http.MethodHead:
+		httpReq.Method = http3.MethodHead0RTT
+	}
+}
@@ -0,0 +1,93 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// countingPacketConn counts the packets a client sends. It embeds the
+// interface so that quic-go can't use the *net.UDPConn fast paths.
+type countingPacketConn struct {
+	net.PacketConn
+	writes atomic.Int32
+}
+
+func (c *countingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.writes.Add(1)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestHTTP3CustomPacketConn(t *testing.T) {
+	base := newTestH3Server(t, protoEchoHandler())
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer udp.Close()
+	pc := &countingPacketConn{PacketConn: udp}
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion:  HTTP3,
+		TLSConfig:    testClientTLSConfig(),
+		HTTP3Options: HTTP3Options{PacketConn: pc},
+	})
+	defer c.CloseIdleConnections()
+
+	if body, _ := doWithInfo(t, c, base); body != "HTTP/3.0" {
+		t.Fatalf("body %q, want HTTP/3.0", body)
+	}
+	if pc.writes.Load() == 0 {
+		t.Fatalf("expected packets to go through the custom PacketConn")
+	}
+}
+
+func TestHTTP3Enable0RTT(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	type connKey struct{}
+	var used0RTT atomic.Int32
+	srv := &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Context().Value(connKey{}).(*quic.Conn).ConnectionState().Used0RTT {
+				used0RTT.Add(1)
+			}
+			_, _ = w.Write([]byte(r.Proto))
+		}),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{testCertificate(t)},
+		}),
+		ConnContext: func(ctx context.Context, c *quic.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+	go func() { _ = srv.Serve(pc) }()
+	defer srv.Close()
+	base := "https://" + pc.LocalAddr().String()
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion:  HTTP3,
+		TLSConfig:    testClientTLSConfig(),
+		HTTP3Options: HTTP3Options{Enable0RTT: true},
+	})
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		if body, _ := doWithInfo(t, c, base); body != "HTTP/3.0" {
+			t.Fatalf("request %d: body %q, want HTTP/3.0", i, body)
+		}
+		// Make the next request resume the session on a new connection.
+		c.CloseIdleConnections()
+	}
+	if used0RTT.Load() != 1 {
+		t.Fatalf("expected the second connection to use 0-RTT, got %d", used0RTT.Load())
+	}
+}
@@ -0,0 +1,218 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/valyala/fasthttp"
+)
+
+// With HTTP3Race, the first request to an origin races a QUIC handshake
+// against TCP+TLS started HTTP3RaceDelay later. The winner carries the
+// request and is remembered for the origin, so a blocked UDP path costs at
+// most the delay instead of a full timeout.
+
+const (
+	defaultHTTP3RaceDelay = 300 * time.Millisecond
+	raceRememberFor       = 10 * time.Minute
+)
+
+type raceResult struct {
+	h3      bool
+	expires time.Time
+}
+
+type h3Racer struct {
+	c     *Client
+	h2    *h2Transport
+	delay time.Duration
+	// tlsConfig and quicConfig are the HTTP/3 transport's, read before
+	// http3 starts changing them.
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mu      sync.Mutex
+	winners map[string]raceResult
+	conns   map[string]*quic.Conn
+}
+
+// newH3Racer returns a racer of QUIC against h2. Its dialH3 has to be the
+// HTTP/3 transport's dialer.
+func newH3Racer(c *Client, h2 *h2Transport, delay time.Duration) *h3Racer {
+	if delay <= 0 {
+		delay = defaultHTTP3RaceDelay
+	}
+	tr := c.httpClient.Transport.(*http3.Transport)
+	return &h3Racer{c: c, h2: h2, delay: delay, tlsConfig: tr.TLSClientConfig, quicConfig: tr.QUICConfig}
+}
+
+func (r *h3Racer) roundTrip(ctx context.Context, req *Request, resp *Response) error {
+	uri := req.URI()
+	if string(uri.Scheme()) != "https" {
+		return r.c.doNetHTTP(ctx, req, resp)
+	}
+	origin := fasthttp.AddMissingPort(string(uri.Host()), true)
+
+	h3, known := r.winner(origin)
+	if !known {
+		var err error
+		h3, err = r.race(ctx, origin)
+		if err != nil {
+			return err
+		}
+		r.remember(origin, h3)
+		if info := requestInfoFromContext(ctx); info != nil {
+			info.Raced = true
+		}
+	}
+	if h3 {
+		h3ctx, sent := trackHeadersSent(ctx)
+		err := r.c.doNetHTTP(h3ctx, req, resp)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() == nil && isQUICError(err) {
+			r.remember(origin, false)
+		}
+		if !h3Replayable(ctx, req, err, sent.Load()) {
+			return err
+		}
+	}
+	return r.c.doNativeHTTP2(ctx, req, resp)
+}
+
+func (r *h3Racer) winner(origin string) (h3, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.winners[origin]
+	if !ok || time.Now().After(w.expires) {
+		return false, false
+	}
+	return w.h3, true
+}
+
+func (r *h3Racer) remember(origin string, h3 bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winners == nil {
+		r.winners = make(map[string]raceResult)
+	}
+	r.winners[origin] = raceResult{h3: h3, expires: time.Now().Add(raceRememberFor)}
+}
+
+// race reports whether QUIC or TCP connected to origin first. The winning
+// connection is left ready for the request.
+func (r *h3Racer) race(ctx context.Context, origin string) (h3 bool, err error) {
+	if timeout := r.c.requestTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		h3  bool
+		err error
+	}
+	results := make(chan result, 2)
+	go func() {
+		results <- result{true, r.dialQUIC(ctx, origin)}
+	}()
+	pending := 1
+	tcpStarted := false
+	startTCP := func() {
+		tcpStarted = true
+		pending++
+		go func() {
+			results <- result{false, r.h2.connect(ctx, origin)}
+		}()
+	}
+
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !tcpStarted {
+				startTCP()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.h3, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !tcpStarted {
+				// QUIC failed early: don't wait for the delay.
+				startTCP()
+			} else if pending == 0 {
+				return false, ctxError(ctx, firstErr)
+			}
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+func (r *h3Racer) dialQUIC(ctx context.Context, addr string) error {
+	tlsCfg := clientTLSConfig(r.tlsConfig, addr, http3.NextProtoH3)
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	conn, err := r.c.dialQUIC(ctx, addr, tlsCfg, r.quicConfig)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-conn.HandshakeComplete():
+	case <-ctx.Done():
+		_ = conn.CloseWithError(0, "")
+		return ctx.Err()
+	}
+	if err := conn.Context().Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old := r.conns[addr]; old != nil {
+		_ = old.CloseWithError(0, "")
+	}
+	if r.conns == nil {
+		r.conns = make(map[string]*quic.Conn)
+	}
+	r.conns[addr] = conn
+	return nil
+}
+
+// dialH3 is the http3.Transport dialer: it hands out the connection that won
+// the race, if any.
+func (r *h3Racer) dialH3(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	r.mu.Lock()
+	conn := r.conns[addr]
+	delete(r.conns, addr)
+	r.mu.Unlock()
+	if conn != nil && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	return r.c.dialQUIC(ctx, addr, tlsCfg, cfg)
+}
+
+func (r *h3Racer) closeIdleConnections() {
+	r.mu.Lock()
+	conns := r.conns
+	r.conns = nil
+	r.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.CloseWithError(0, "")
+	}
+}
@@ -0,0 +1,175 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/valyala/fasthttp"
+)
+
+// newTestRaceOrigin starts an h2 server on a TCP port and binds the same
+// UDP port, either to an HTTP/3 server or to a socket that never answers.
+func newTestRaceOrigin(t *testing.T, withH3 bool) string {
+	t.Helper()
+	var serveH3 func(net.PacketConn)
+	if withH3 {
+		serveH3 = func(pc net.PacketConn) {
+			h3 := &http3.Server{
+				Handler: protoEchoHandler(),
+				TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+					Certificates: []tls.Certificate{testCertificate(t)},
+				}),
+			}
+			go func() { _ = h3.Serve(pc) }()
+			t.Cleanup(func() { _ = h3.Close() })
+		}
+	}
+	return newTestRaceOriginWith(t, protoEchoHandler(), serveH3)
+}
+
+// newTestRaceOriginWith starts an h2 server with handler h on a TCP port,
+// and has serveH3, if set, serve the same UDP port.
+func newTestRaceOriginWith(t *testing.T, h http.Handler, serveH3 func(pc net.PacketConn)) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen tcp: %v", err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		pc, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			ln.Close()
+			continue
+		}
+
+		srv := httptest.NewUnstartedServer(h)
+		srv.Listener.Close()
+		srv.Listener = ln
+		srv.EnableHTTP2 = true
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+
+		if serveH3 != nil {
+			serveH3(pc)
+		}
+		t.Cleanup(func() { _ = pc.Close() })
+		return srv.URL
+	}
+	t.Fatalf("could not bind the same TCP and UDP port")
+	return ""
+}
+
+func newRaceClient(delay time.Duration) *Client {
+	return NewClientWithOptions(ClientOptions{
+		HTTPVersion:    HTTP3,
+		TLSConfig:      testClientTLSConfig(),
+		HTTP3Race:      true,
+		HTTP3RaceDelay: delay,
+	})
+}
+
+func doWithInfo(t *testing.T, c *Client, url string) (string, RequestInfo) {
+	t.Helper()
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(url)
+
+	var info RequestInfo
+	if err := c.DoCtx(WithRequestInfo(context.Background(), &info), req, resp); err != nil {
+		t.Fatalf("DoCtx: %v", err)
+	}
+	return string(resp.Body()), info
+}
+
+func TestHTTP3RaceQUICWins(t *testing.T) {
+	base := newTestRaceOrigin(t, true)
+	c := newRaceClient(time.Second)
+	defer c.CloseIdleConnections()
+
+	body, info := doWithInfo(t, c, base)
+	if body != "HTTP/3.0" || info.Protocol != "HTTP/3.0" || !info.Raced {
+		t.Fatalf("first request: body %q, info %+v", body, info)
+	}
+	body, info = doWithInfo(t, c, base)
+	if body != "HTTP/3.0" || info.Protocol != "HTTP/3.0" || info.Raced {
+		t.Fatalf("second request: body %q, info %+v", body, info)
+	}
+}
+
+func TestHTTP3RaceBlockedUDP(t *testing.T) {
+	base := newTestRaceOrigin(t, false)
+	c := newRaceClient(50 * time.Millisecond)
+	defer c.CloseIdleConnections()
+
+	start := time.Now()
+	body, info := doWithInfo(t, c, base)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("request took %v with UDP blocked", elapsed)
+	}
+	if body != "HTTP/2.0" || info.Protocol != "HTTP/2.0" || !info.Raced {
+		t.Fatalf("first request: body %q, info %+v", body, info)
+	}
+
+	// The TCP win is remembered: no new QUIC attempt.
+	body, info = doWithInfo(t, c, base)
+	if body != "HTTP/2.0" || info.Raced {
+		t.Fatalf("second request: body %q, info %+v", body, info)
+	}
+	if h3, ok := c.current().race.winner(base[len("https://"):]); !ok || h3 {
+		t.Fatalf("winner = %v, %v; want TCP", h3, ok)
+	}
+}
+
+func TestHTTP3RaceDoesNotReplaySentPOST(t *testing.T) {
+	h2Posts := new(atomic.Int32)
+	var h3Posts *atomic.Int32
+	base := newTestRaceOriginWith(t, countPOSTs(protoEchoHandler(), h2Posts), func(pc net.PacketConn) {
+		h3Posts = newTestVanishingH3Server(t, pc)
+	})
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion:    HTTP3,
+		TLSConfig:      testClientTLSConfig(),
+		HTTP3Race:      true,
+		HTTP3RaceDelay: time.Second,
+		HTTP3Options:   HTTP3Options{MaxIdleTimeout: 300 * time.Millisecond},
+	})
+	defer c.CloseIdleConnections()
+	if body, _ := doWithInfo(t, c, base); body != "HTTP/3.0" {
+		t.Fatalf("body = %q, want HTTP/3.0", body)
+	}
+
+	if _, _, err := c.PostBytes(base, []byte("a=1")); err == nil {
+		t.Fatalf("expected the POST to fail")
+	}
+	if h3Posts.Load() != 1 || h2Posts.Load() != 0 {
+		t.Fatalf("POST sent %d times over HTTP/3 and %d over HTTP/2", h3Posts.Load(), h2Posts.Load())
+	}
+	// The next request doesn't try QUIC again.
+	if body, _ := doWithInfo(t, c, base); body != "HTTP/2.0" {
+		t.Fatalf("body = %q, want HTTP/2.0", body)
+	}
+}
+
+func TestRequestInfoProtocolHTTP1(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	defer srv.Close()
+
+	_, info := doWithInfo(t, &Client{}, srv.URL)
+	if info.Protocol != "HTTP/1.1" {
+		t.Fatalf("Protocol = %q", info.Protocol)
+	}
+}
@@ -0,0 +1,57 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// RequestInfo reports how a request made with DoCtx was carried out.
+type RequestInfo struct {
+	// Protocol the response was received over: "HTTP/1.1", "HTTP/2.0" or
+	// "HTTP/3.0".
+	Protocol string
+	// Raced is true when a QUIC/TCP race decided the protocol.
+	Raced bool
+	// Downgraded is true when HTTP/3 was asked for but the request went
+	// over HTTP/2 because the proxy can't carry UDP.
+	Downgraded bool
+	// TLS is the state of the connection the response came over, or nil
+	// for plain HTTP.
+	TLS *tls.ConnectionState
+	// Uncompressed is true when net/http transparently decompressed the
+	// body, dropping its Content-Encoding and Content-Length.
+	Uncompressed bool
+	// Attempts lists the attempts of a request made through a ClientPool
+	// with a FailoverPolicy.
+	Attempts []PoolAttempt
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a context that makes DoCtx fill in info.
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+func setRequestProtocol(ctx context.Context, proto string) {
+	if info := requestInfoFromContext(ctx); info != nil {
+		info.Protocol = proto
+	}
+}
+
+func setRequestTLS(ctx context.Context, conn net.Conn) {
+	info := requestInfoFromContext(ctx)
+	if info == nil {
+		return
+	}
+	if tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tc.ConnectionState()
+		info.TLS = &state
+	}
+}
@@ -0,0 +1,288 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// A proxy set on the context of a request replaces the client's proxy
+// settings for that request only. Connections made through it are pooled
+// apart from the others, under keys prefixed with the proxy URL, so one
+// client can keep connections to many proxies at once.
+
+type requestProxyKey struct{}
+
+// WithProxy returns a context that makes DoCtx send the request through p
+// instead of the client's proxy settings. A zero ProxySpec connects
+// directly.
+func WithProxy(ctx context.Context, p ProxySpec) context.Context {
+	return context.WithValue(ctx, requestProxyKey{}, &p)
+}
+
+func requestProxyFromContext(ctx context.Context) *ProxySpec {
+	p, _ := ctx.Value(requestProxyKey{}).(*ProxySpec)
+	return p
+}
+
+// checkRequestProxy rejects a proxy set with WithProxy that ParseProxy
+// wouldn't have returned.
+func checkRequestProxy(p *ProxySpec) error {
+	if p == nil || *p == (ProxySpec{}) {
+		return nil
+	}
+	_, err := parseProxy(p.URL().String(), "")
+	return err
+}
+
+// proxyPoolKey is the pool key prefix of connections made through p, or ""
+// for the client's own proxy settings.
+func proxyPoolKey(p *ProxySpec) string {
+	switch {
+	case p == nil:
+		return ""
+	case p.Scheme == "":
+		return "direct|"
+	}
+	return p.URL().String() + "|"
+}
+
+// splitProxyPoolKey undoes proxyPoolKey(p) + addr.
+func splitProxyPoolKey(key string) (prefix, addr string, p *ProxySpec, err error) {
+	i := strings.LastIndexByte(key, '|')
+	if i < 0 {
+		return "", key, nil, nil
+	}
+	prefix, addr = key[:i+1], key[i+1:]
+	if prefix == "direct|" {
+		return prefix, addr, &ProxySpec{}, nil
+	}
+	spec, err := ParseProxy(key[:i])
+	if err != nil {
+		return "", "", nil, err
+	}
+	return prefix, addr, &spec, nil
+}
+
+// proxyDialError is the error of a connection through a proxy set with
+// WithProxy that couldn't be made: the request wasn't sent.
+type proxyDialError struct {
+	err error
+}
+
+func (e *proxyDialError) Error() string { return e.err.Error() }
+func (e *proxyDialError) Unwrap() error { return e.err }
+
+// proxyDialer returns the TCP dialer for connections through p, or the
+// client's dialer if p is nil.
+func (c *Client) proxyDialer(p *ProxySpec) dialContextFunc {
+	if p == nil {
+		return c.dialer()
+	}
+	dial := dialDirect
+	if p.Scheme != "" {
+		d, err := chainDialer([]ProxySpec{*p}, c.TLSConfig)
+		if err != nil {
+			return func(context.Context, string, string) (net.Conn, error) {
+				return nil, err
+			}
+		}
+		dial = d
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, &proxyDialError{err}
+		}
+		return conn, nil
+	}
+}
+
+// maxRequestProxies caps the proxies a client keeps connections to for the
+// requests made with WithProxy. Past it, the connections through the least
+// recently used proxy are closed.
+const maxRequestProxies = 64
+
+type proxyClients struct {
+	mu      sync.Mutex
+	proxies map[string]*requestProxy
+	h2      *h2Transport
+}
+
+// requestProxy is what a client keeps for a proxy set with WithProxy.
+type requestProxy struct {
+	hc       *http.Client
+	lastUsed time.Time
+}
+
+// useRequestProxy records a request through the proxy with pool key prefix
+// key, and lets go of the least recently used proxy if there are too many.
+func (c *Client) useRequestProxy(key string) *requestProxy {
+	p := &c.proxyClients
+	p.mu.Lock()
+	rp := p.proxies[key]
+	if rp == nil {
+		if p.proxies == nil {
+			p.proxies = make(map[string]*requestProxy)
+		}
+		rp = &requestProxy{}
+		p.proxies[key] = rp
+	}
+	rp.lastUsed = time.Now()
+	var oldKey string
+	var old *requestProxy
+	if len(p.proxies) > maxRequestProxies {
+		for k, e := range p.proxies {
+			if old == nil || e.lastUsed.Before(old.lastUsed) {
+				oldKey, old = k, e
+			}
+		}
+		delete(p.proxies, oldKey)
+	}
+	h2 := p.h2
+	p.mu.Unlock()
+
+	if old != nil {
+		if old.hc != nil {
+			old.hc.CloseIdleConnections()
+		}
+		c.h1Conns.closeIdle(oldKey)
+		if h2 != nil {
+			h2.forget(oldKey)
+		}
+		if h2 := c.current().h2; h2 != nil {
+			h2.forget(oldKey)
+		}
+	}
+	return rp
+}
+
+// requestHTTPClient returns the net/http client for the request: the
+// client's own, or one kept for the request's proxy.
+func (c *Client) requestHTTPClient(ctx context.Context) *http.Client {
+	p := requestProxyFromContext(ctx)
+	if p == nil {
+		return c.httpClient
+	}
+	rp := c.useRequestProxy(proxyPoolKey(p))
+	c.proxyClients.mu.Lock()
+	defer c.proxyClients.mu.Unlock()
+	if rp.hc != nil {
+		return rp.hc
+	}
+	hc := &http.Client{
+		CheckRedirect: c.httpClient.CheckRedirect,
+		Timeout:       c.httpClient.Timeout,
+		Jar:           c.httpClient.Jar,
+	}
+	switch base := c.httpClient.Transport.(type) {
+	case *http.Transport:
+		hc.Transport = c.proxyHTTPTransport(base, *p)
+	case *http3.Transport:
+		h3 := &http3.Transport{
+			TLSClientConfig: sessionsThrough(base.TLSClientConfig, p),
+			QUICConfig:      tokensThrough(base.QUICConfig, p),
+			EnableDatagrams: base.EnableDatagrams,
+		}
+		dial := c.dialQUIC
+		switch p.Scheme {
+		case "masque":
+			dial = newMASQUEDialer(*p, c.TLSConfig).dialQUIC
+		case "socks5", "socks5h":
+			dial = newSOCKS5UDPDialer(*p, dialDirect).dialQUIC
+		}
+		h3.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			conn, err := dial(ctx, addr, tlsCfg, cfg)
+			if err != nil {
+				return nil, &proxyDialError{err}
+			}
+			return conn, nil
+		}
+		hc.Transport = h3
+	default:
+		return c.httpClient
+	}
+	rp.hc = hc
+	return hc
+}
+
+// proxyHTTPTransport returns a transport like base going through p. It
+// isn't a Clone of base, which would share base's HTTP/2 connection pool.
+func (c *Client) proxyHTTPTransport(base *http.Transport, p ProxySpec) *http.Transport {
+	tr := &http.Transport{
+		TLSClientConfig: sessionsThrough(base.TLSClientConfig, &p),
+		MaxConnsPerHost: base.MaxConnsPerHost,
+		IdleConnTimeout: base.IdleConnTimeout,
+		ReadBufferSize:  base.ReadBufferSize,
+		WriteBufferSize: base.WriteBufferSize,
+	}
+	if base.Protocols != nil {
+		protocols := *base.Protocols
+		tr.Protocols = &protocols
+	} else {
+		_ = http2.ConfigureTransport(tr)
+	}
+	switch p.Scheme {
+	case "http", "https":
+		// net/http dials the proxy and sends it CONNECT itself.
+		tr.Proxy = http.ProxyURL(p.URL())
+		tr.DialContext = c.proxyDialer(&ProxySpec{})
+	default:
+		tr.DialContext = c.proxyDialer(&p)
+	}
+	return tr
+}
+
+// requestH2 returns the native HTTP/2 transport used for requests whose
+// proxy can't carry HTTP/3.
+func (c *Client) requestH2() *h2Transport {
+	if h2 := c.current().h2; h2 != nil {
+		return h2
+	}
+	c.proxyClients.mu.Lock()
+	defer c.proxyClients.mu.Unlock()
+	if c.proxyClients.h2 == nil {
+		c.proxyClients.h2 = newH2Transport(c)
+	}
+	return c.proxyClients.h2
+}
+
+// roundTripProxied sends a request of an HTTP3 or HTTPAuto client that has
+// a proxy of its own: over HTTP/3 if the proxy carries UDP, otherwise over
+// HTTP/2.
+func (c *Client) roundTripProxied(ctx context.Context, p *ProxySpec, req *Request, resp *Response) error {
+	if c.httpVersion == HTTP3 {
+		if p.Scheme == "" || p.carriesUDP() {
+			err := c.doNetHTTP(ctx, req, resp)
+			if !errors.Is(err, ErrProxyUDPUnsupported) || req.IsBodyStream() {
+				return err
+			}
+		}
+		if info := requestInfoFromContext(ctx); info != nil {
+			info.Downgraded = true
+		}
+	}
+	return c.doNativeHTTP2(ctx, req, resp)
+}
+
+func (p *proxyClients) closeIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rp := range p.proxies {
+		if rp.hc != nil {
+			rp.hc.CloseIdleConnections()
+		}
+	}
+	if p.h2 != nil {
+		p.h2.closeIdleConnections()
+	}
+}
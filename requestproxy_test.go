@@ -0,0 +1,195 @@
+package v2fasthttp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TestWithProxy sends requests of one client through two proxies set per
+// request, directly, and through the client's own proxy, and checks that
+// connections are reused per proxy.
+func TestWithProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     ClientOptions
+		version HTTPVersion
+	}{
+		{"HTTP1", ClientOptions{}, HTTP1},
+		{"HTTP2", ClientOptions{}, HTTP2},
+		{"HTTP2NetHTTP", ClientOptions{DisableNativeHTTP2: true}, HTTP2},
+		{"HTTP3", ClientOptions{}, HTTP3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, _ := newTestServerForVersion(t, tt.version, protoEchoHandler())
+			proxyA := newTestSOCKS5Server(t, false)
+			proxyB := newTestSOCKS5Server(t, false)
+			clientProxy := newTestSOCKS5Server(t, false)
+			used := func(s *testSOCKS5Server) int32 { return s.connects.Load() + s.associates.Load() }
+
+			opt := tt.opt
+			opt.HTTPVersion = tt.version
+			opt.TLSConfig = testClientTLSConfig()
+			c := NewClientWithOptions(opt)
+			defer c.CloseIdleConnections()
+			if err := c.SetProxy(clientProxy.URL()); err != nil {
+				t.Fatal(err)
+			}
+
+			do := func(p *ProxySpec) {
+				t.Helper()
+				ctx := context.Background()
+				if p != nil {
+					ctx = WithProxy(ctx, *p)
+				}
+				req := fasthttp.AcquireRequest()
+				defer fasthttp.ReleaseRequest(req)
+				resp := fasthttp.AcquireResponse()
+				defer fasthttp.ReleaseResponse(resp)
+				req.SetRequestURI(base)
+				if err := c.DoCtx(ctx, req, resp); err != nil || resp.StatusCode() != 200 {
+					t.Fatalf("DoCtx through %v: status %d, err %v", p, resp.StatusCode(), err)
+				}
+			}
+			specA, _ := ParseProxy(proxyA.URL())
+			specB, _ := ParseProxy(proxyB.URL())
+
+			do(&specA)
+			do(&specB)
+			do(&specA)
+			do(&specB)
+			if used(proxyA) != 1 || used(proxyB) != 1 {
+				t.Fatalf("proxy A used %d times, B %d times; want one connection each", used(proxyA), used(proxyB))
+			}
+			if used(clientProxy) != 0 {
+				t.Fatalf("the client's proxy was used for per-request proxies")
+			}
+
+			do(nil)
+			if used(clientProxy) != 1 {
+				t.Fatalf("the client's proxy wasn't used without a per-request proxy")
+			}
+			do(&ProxySpec{})
+			if used(proxyA)+used(proxyB)+used(clientProxy) != 3 {
+				t.Fatalf("a direct request went through a proxy")
+			}
+		})
+	}
+}
+
+func TestWithProxyHTTP3Downgrades(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	httpProxy := newTestHTTPProxy(t, false, "")
+	p, err := ParseProxy(httpProxy.URL(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClientWithOptions(ClientOptions{HTTPVersion: HTTP3, TLSConfig: testClientTLSConfig()})
+	defer c.CloseIdleConnections()
+
+	var info RequestInfo
+	ctx := WithRequestInfo(WithProxy(context.Background(), p), &info)
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(srv.URL)
+	if err := c.DoCtx(ctx, req, resp); err != nil {
+		t.Fatalf("DoCtx: %v", err)
+	}
+	if string(resp.Body()) != "HTTP/2.0" || !info.Downgraded {
+		t.Fatalf("body %q, Downgraded %v", resp.Body(), info.Downgraded)
+	}
+	if httpProxy.connects.Load() != 1 {
+		t.Fatalf("the proxy wasn't used")
+	}
+	if c.HTTP3Downgrade() != nil {
+		t.Fatalf("a per-request proxy downgraded the client")
+	}
+}
+
+func TestWithProxyInvalid(t *testing.T) {
+	c := NewClientWithOptions(ClientOptions{HTTPVersion: HTTP2})
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("https://127.0.0.1:1/")
+	for _, p := range []ProxySpec{
+		{Scheme: "ftp", Addr: "127.0.0.1:21"},
+		{Addr: "127.0.0.1:8080"},
+	} {
+		if err := c.DoCtx(WithProxy(context.Background(), p), req, resp); err == nil {
+			t.Fatalf("%+v: expected an error", p)
+		}
+	}
+}
+
+// TestWithProxyForgetsLeastRecentlyUsed rotates through more proxies than a
+// client keeps connections to.
+func TestWithProxyForgetsLeastRecentlyUsed(t *testing.T) {
+	tests := []struct {
+		name    string
+		version HTTPVersion
+	}{
+		{"HTTP1", HTTP1},
+		{"HTTP2", HTTP2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, c := newTestServerForVersion(t, tt.version, protoEchoHandler())
+			defer c.CloseIdleConnections()
+			proxy := newTestHTTPProxy(t, false, "")
+
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			req.SetRequestURI(base)
+			var first string
+			for i := 0; i <= maxRequestProxies; i++ {
+				p, err := ParseProxy(proxy.URL(fmt.Sprintf("user%d:pass", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					first = proxyPoolKey(&p)
+				}
+				if err := c.DoCtx(WithProxy(context.Background(), p), req, resp); err != nil {
+					t.Fatalf("DoCtx through proxy %d: %v", i, err)
+				}
+			}
+
+			c.proxyClients.mu.Lock()
+			n, kept := len(c.proxyClients.proxies), c.proxyClients.proxies[first] != nil
+			c.proxyClients.mu.Unlock()
+			if n != maxRequestProxies || kept {
+				t.Fatalf("%d proxies kept, first one among them: %v", n, kept)
+			}
+			c.h1Conns.mu.Lock()
+			for key := range c.h1Conns.idle {
+				if strings.HasPrefix(key, first) {
+					t.Errorf("idle HTTP/1.1 connection left through the first proxy")
+				}
+			}
+			c.h1Conns.mu.Unlock()
+			if h2 := c.current().h2; h2 != nil {
+				h2.mu.Lock()
+				for key := range h2.conns {
+					if strings.HasPrefix(key, first) {
+						t.Errorf("HTTP/2 connection left through the first proxy")
+					}
+				}
+				h2.mu.Unlock()
+			}
+		})
+	}
+
+	if _, _, _, err := splitProxyPoolKey("ftp://127.0.0.1:21|example.com:443"); err == nil {
+		t.Fatalf("expected an error for an unparsable pool key")
+	}
+}
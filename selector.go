@@ -0,0 +1,164 @@
+package v2fasthttp
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// Selector picks the client of each request of a ClientPool.
+type Selector interface {
+	// Select returns one of members, the healthy clients of the pool, for
+	// req. members is never empty and must not be modified. req is nil for
+	// ClientPool.Next.
+	Select(req *Request, members []*PoolMember) *PoolMember
+}
+
+type roundRobinSelector struct {
+	idx atomic.Uint32
+}
+
+// NewRoundRobinSelector returns a selector taking the clients in turn.
+func NewRoundRobinSelector() Selector {
+	return &roundRobinSelector{}
+}
+
+func (s *roundRobinSelector) Select(_ *Request, members []*PoolMember) *PoolMember {
+	return members[s.idx.Add(1)%uint32(len(members))]
+}
+
+type leastInFlightSelector struct {
+	idx atomic.Uint32
+}
+
+// NewLeastInFlightSelector returns a selector picking the client with the
+// fewest requests under way, taking tied clients in turn.
+func NewLeastInFlightSelector() Selector {
+	return &leastInFlightSelector{}
+}
+
+func (s *leastInFlightSelector) Select(_ *Request, members []*PoolMember) *PoolMember {
+	n := uint32(len(members))
+	start := s.idx.Add(1)
+	best := members[start%n]
+	for i := uint32(1); i < n; i++ {
+		if m := members[(start+i)%n]; m.InFlight() < best.InFlight() {
+			best = m
+		}
+	}
+	return best
+}
+
+type weightedSelector struct {
+	weight func(*Client) int
+	mu     sync.Mutex
+}
+
+// NewWeightedSelector returns a selector giving each client a share of the
+// requests proportional to its weight, spread evenly over time (smooth
+// weighted round-robin). weight is called once per client; weights below 1
+// count as 1, and a nil weight gives every client a weight of 1.
+func NewWeightedSelector(weight func(c *Client) int) Selector {
+	if weight == nil {
+		weight = func(*Client) int { return 1 }
+	}
+	return &weightedSelector{weight: weight}
+}
+
+func (s *weightedSelector) Select(_ *Request, members []*PoolMember) *PoolMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *PoolMember
+	var total int64
+	for _, m := range members {
+		w := m.weight.Load()
+		if w == 0 {
+			w = int64(max(s.weight(m.client), 1))
+			m.weight.Store(w)
+		}
+		m.current += w
+		total += w
+		if best == nil || m.current > best.current {
+			best = m
+		}
+	}
+	best.current -= total
+	return best
+}
+
+type p2cSelector struct{}
+
+// NewP2CSelector returns a selector comparing two clients picked at random
+// and taking the one with the lower latency average weighted by its
+// requests under way (power of two choices). Clients without a latency
+// figure yet are taken first.
+func NewP2CSelector() Selector {
+	return p2cSelector{}
+}
+
+func (p2cSelector) Select(_ *Request, members []*PoolMember) *PoolMember {
+	if len(members) == 1 {
+		return members[0]
+	}
+	i := rand.IntN(len(members))
+	j := rand.IntN(len(members) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := members[i], members[j]
+	if p2cCost(b) < p2cCost(a) {
+		return b
+	}
+	return a
+}
+
+func p2cCost(m *PoolMember) float64 {
+	return float64(m.Latency()) * float64(m.InFlight()+1)
+}
+
+type randomSelector struct{}
+
+// NewRandomSelector returns a selector picking clients uniformly at random.
+func NewRandomSelector() Selector {
+	return randomSelector{}
+}
+
+func (randomSelector) Select(_ *Request, members []*PoolMember) *PoolMember {
+	return members[rand.IntN(len(members))]
+}
+
+type consistentHashSelector struct{}
+
+// NewConsistentHashSelector returns a selector sending the requests to a
+// host to the same client. When clients are evicted or reinstated, only
+// the hosts of those clients move (rendezvous hashing).
+func NewConsistentHashSelector() Selector {
+	return consistentHashSelector{}
+}
+
+func (consistentHashSelector) Select(req *Request, members []*PoolMember) *PoolMember {
+	h := fnv.New64a()
+	if req != nil {
+		_, _ = h.Write(req.URI().Host())
+	}
+	key := h.Sum64()
+	var best *PoolMember
+	var bestScore uint64
+	for _, m := range members {
+		if score := mix64(key ^ mix64(m.id+1)); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
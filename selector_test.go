@@ -0,0 +1,166 @@
+package v2fasthttp
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testPoolMembers(n int) []*PoolMember {
+	members := make([]*PoolMember, n)
+	for i := range members {
+		members[i] = &PoolMember{client: &Client{}, id: uint64(i)}
+	}
+	return members
+}
+
+func countSelections(s Selector, req *Request, members []*PoolMember, n int) map[*PoolMember]int {
+	counts := make(map[*PoolMember]int)
+	for i := 0; i < n; i++ {
+		counts[s.Select(req, members)]++
+	}
+	return counts
+}
+
+func TestRoundRobinAndRandomSelectors(t *testing.T) {
+	members := testPoolMembers(3)
+	counts := countSelections(NewRoundRobinSelector(), nil, members, 30)
+	for _, m := range members {
+		if counts[m] != 10 {
+			t.Fatalf("round-robin: uneven counts %v", counts)
+		}
+	}
+	counts = countSelections(NewRandomSelector(), nil, members, 300)
+	for _, m := range members {
+		if counts[m] == 0 {
+			t.Fatalf("random: a member was never picked: %v", counts)
+		}
+	}
+}
+
+func TestLeastInFlightSelector(t *testing.T) {
+	members := testPoolMembers(3)
+	members[0].inFlight.Store(2)
+	members[2].inFlight.Store(1)
+	s := NewLeastInFlightSelector()
+	for i := 0; i < 5; i++ {
+		if m := s.Select(nil, members); m != members[1] {
+			t.Fatalf("picked member %d", m.id)
+		}
+	}
+	members[1].inFlight.Store(1)
+	counts := countSelections(s, nil, members, 10)
+	if counts[members[0]] != 0 || counts[members[1]] == 0 || counts[members[2]] == 0 {
+		t.Fatalf("tied members weren't taken in turn: %v", counts)
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	members := testPoolMembers(3)
+	weights := map[*Client]int{members[0].client: 3, members[1].client: 1, members[2].client: 0}
+	s := NewWeightedSelector(func(c *Client) int { return weights[c] })
+	var order []uint64
+	for i := 0; i < 10; i++ {
+		order = append(order, s.Select(nil, members).id)
+	}
+	counts := map[uint64]int{}
+	for i, id := range order {
+		counts[id]++
+		if i >= 2 && order[i-2] == id && order[i-1] == id && id == 0 {
+			t.Fatalf("weighted picks aren't spread: %v", order)
+		}
+	}
+	if counts[0] != 6 || counts[1] != 2 || counts[2] != 2 {
+		t.Fatalf("expected 6/2/2 picks, got %v (%v)", counts, order)
+	}
+
+	// Without a weight function the clients take turns.
+	s = NewWeightedSelector(nil)
+	members = testPoolMembers(3)
+	for i := 0; i < 6; i++ {
+		if m := s.Select(nil, members); m.id != uint64(i%3) {
+			t.Fatalf("pick %d went to member %d", i, m.id)
+		}
+	}
+}
+
+func TestP2CSelector(t *testing.T) {
+	members := testPoolMembers(2)
+	members[0].latency.Store(int64(10 * time.Millisecond))
+	members[1].latency.Store(int64(time.Millisecond))
+	s := NewP2CSelector()
+	for i := 0; i < 10; i++ {
+		if m := s.Select(nil, members); m != members[1] {
+			t.Fatalf("picked the slow member")
+		}
+	}
+	// Enough requests under way outweigh the lower latency.
+	members[1].inFlight.Store(20)
+	if m := s.Select(nil, members); m != members[0] {
+		t.Fatalf("picked the loaded member")
+	}
+	if m := s.Select(nil, members[:1]); m != members[0] {
+		t.Fatalf("picked %v from a single member", m.id)
+	}
+}
+
+func TestConsistentHashSelector(t *testing.T) {
+	members := testPoolMembers(5)
+	s := NewConsistentHashSelector()
+	picks := make(map[string]*PoolMember)
+	used := make(map[*PoolMember]bool)
+	for i := 0; i < 50; i++ {
+		var req Request
+		host := fmt.Sprintf("host%d.example.com", i)
+		req.SetRequestURI("https://" + host + "/")
+		picks[host] = s.Select(&req, members)
+		used[picks[host]] = true
+		if again := s.Select(&req, members); again != picks[host] {
+			t.Fatalf("%s moved between requests", host)
+		}
+	}
+	if len(used) < 3 {
+		t.Fatalf("hosts weren't spread: %d members used", len(used))
+	}
+
+	// Dropping a member only moves its own hosts.
+	rest := append(append([]*PoolMember{}, members[:2]...), members[3:]...)
+	for host, m := range picks {
+		var req Request
+		req.SetRequestURI("https://" + host + "/")
+		if got := s.Select(&req, rest); m != members[2] && got != m {
+			t.Fatalf("%s moved off a remaining member", host)
+		}
+	}
+}
+
+func TestClientPoolWithSelector(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	a := newTestHTTPProxy(t, false, "")
+	b := newTestHTTPProxy(t, false, "")
+	pool := NewClientPoolWithOptions(ClientPoolOptions{
+		Clients:  []*Client{NewHighPerfClient(a.URL("")), NewHighPerfClient(b.URL(""))},
+		Selector: NewConsistentHashSelector(),
+	})
+
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	for i := 0; i < 5; i++ {
+		if err := pool.Do(&req, &resp); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+	}
+	if a.connects.Load() != 0 && b.connects.Load() != 0 {
+		t.Fatalf("requests to one host went through both proxies")
+	}
+	used := pool.memberList()[0]
+	if b.connects.Load() != 0 {
+		used = pool.memberList()[1]
+	}
+	if used.Latency() <= 0 || used.InFlight() != 0 {
+		t.Fatalf("unexpected figures: latency %v, in flight %d", used.Latency(), used.InFlight())
+	}
+}
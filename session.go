@@ -0,0 +1,114 @@
+package v2fasthttp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultSessionTTL = 10 * time.Minute
+
+// Session sends requests through one client of a ClientPool, so that
+// multi-step flows keep the same proxy and egress IP. The client is picked
+// by the pool's selector on the first request, and again once the session
+// has been idle for the pool's session TTL or its client has been evicted
+// or removed.
+type Session struct {
+	pool *ClientPool
+	key  string
+}
+
+type poolSessions struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	pins      map[string]*sessionPin
+	lastSweep time.Time
+}
+
+type sessionPin struct {
+	member  *PoolMember
+	expires time.Time
+}
+
+// Session returns the session named key. Sessions with the same key share
+// their client.
+func (p *ClientPool) Session(key string) *Session {
+	return &Session{pool: p, key: key}
+}
+
+// SetSessionTTL sets how long a session stays on its client without
+// requests. ttl <= 0 restores the default of 10 minutes.
+func (p *ClientPool) SetSessionTTL(ttl time.Duration) {
+	if p == nil {
+		return
+	}
+	p.sessions.mu.Lock()
+	p.sessions.ttl = ttl
+	p.sessions.mu.Unlock()
+}
+
+// Client returns the session's client, or nil if the pool has no healthy
+// one. Requests made with it directly don't count towards the load and
+// latency figures of the pool.
+func (s *Session) Client() *Client {
+	m := s.pool.sessionMember(s.key, nil)
+	if m == nil {
+		return nil
+	}
+	return m.client
+}
+
+func (s *Session) Do(req *Request, resp *Response) error {
+	return s.do(context.Background(), req, resp, func(c *Client) error { return c.Do(req, resp) })
+}
+
+func (s *Session) DoCtx(ctx context.Context, req *Request, resp *Response) error {
+	return s.do(ctx, req, resp, func(c *Client) error { return c.DoCtx(ctx, req, resp) })
+}
+
+func (s *Session) do(ctx context.Context, req *Request, resp *Response, do func(*Client) error) error {
+	m := s.pool.sessionMember(s.key, req)
+	if m == nil {
+		return s.pool.noClientError()
+	}
+	return s.pool.doMember(ctx, m, resp, do)
+}
+
+// sessionMember returns the member the session key is pinned to, pinning
+// it to a new one if needed.
+func (p *ClientPool) sessionMember(key string, req *Request) *PoolMember {
+	if p == nil {
+		return nil
+	}
+	ps := &p.sessions
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ttl := ps.ttl
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	now := time.Now()
+	if now.Sub(ps.lastSweep) >= ttl {
+		for k, pin := range ps.pins {
+			if now.After(pin.expires) {
+				delete(ps.pins, k)
+			}
+		}
+		ps.lastSweep = now
+	}
+
+	pin := ps.pins[key]
+	if pin == nil || now.After(pin.expires) || pin.member.evicted.Load() || pin.member.removed.Load() {
+		m := p.next(req)
+		if m == nil {
+			return nil
+		}
+		pin = &sessionPin{member: m}
+		if ps.pins == nil {
+			ps.pins = make(map[string]*sessionPin)
+		}
+		ps.pins[key] = pin
+	}
+	pin.expires = now.Add(ttl)
+	return pin.member
+}
@@ -0,0 +1,102 @@
+package v2fasthttp
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientPoolSession(t *testing.T) {
+	srv := httptest.NewServer(protoEchoHandler())
+	defer srv.Close()
+	proxies := []*testHTTPProxy{
+		newTestHTTPProxy(t, false, ""),
+		newTestHTTPProxy(t, false, ""),
+		newTestHTTPProxy(t, false, ""),
+	}
+	pool := NewProxyClientPool([]string{proxies[0].URL(""), proxies[1].URL(""), proxies[2].URL("")}, 1)
+	connects := func() (n []int32) {
+		for _, p := range proxies {
+			n = append(n, p.connects.Load())
+		}
+		return n
+	}
+
+	var req Request
+	var resp Response
+	req.SetRequestURI(srv.URL + "/")
+	s := pool.Session("login")
+	pinned := s.Client()
+	for i := 0; i < 5; i++ {
+		if err := s.Do(&req, &resp); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+	}
+	for i, n := range connects() {
+		if (n != 0) != (pool.memberList()[i].client == pinned) {
+			t.Fatalf("expected connects through the pinned proxy only, got %v", connects())
+		}
+	}
+	if pool.Session("login").Client() != pinned {
+		t.Fatalf("a session with the same key got another client")
+	}
+	if pool.Session("other").Client() == pinned {
+		t.Fatalf("a new session got the pinned client of another")
+	}
+
+	// An evicted client is replaced, and the session stays on the new one.
+	if err := pool.EnableHealthChecks(HealthCheckOptions{CheckURL: srv.URL + "/", MaxFailures: 1, Interval: time.Hour}); err != nil {
+		t.Fatalf("EnableHealthChecks: %v", err)
+	}
+	defer pool.StopHealthChecks()
+	down := -1
+	for i, m := range pool.memberList() {
+		if m.client == pinned {
+			down = i
+		}
+	}
+	proxies[down].down.Store(true)
+	pinned.CloseIdleConnections()
+	if err := s.Do(&req, &resp); err == nil {
+		t.Fatalf("expected the request through the downed proxy to fail")
+	}
+	if err := s.Do(&req, &resp); err != nil {
+		t.Fatalf("Do after eviction: %v", err)
+	}
+	repinned := s.Client()
+	if repinned == pinned || repinned == nil {
+		t.Fatalf("the session wasn't re-pinned")
+	}
+	before := connects()
+	for i := 0; i < 3; i++ {
+		repinned.CloseIdleConnections()
+		if err := s.Do(&req, &resp); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+	}
+	after := connects()
+	for i := range proxies {
+		if moved := after[i] != before[i]; moved != (pool.memberList()[i].client == repinned) {
+			t.Fatalf("connects went %v -> %v, expected only the re-pinned proxy", before, after)
+		}
+	}
+}
+
+func TestClientPoolSessionTTL(t *testing.T) {
+	pool := NewClientPoolWithOptions(ClientPoolOptions{
+		Clients:    []*Client{{}, {}, {}},
+		SessionTTL: 20 * time.Millisecond,
+	})
+	s := pool.Session("k")
+	first := s.Client()
+	if s.Client() != first {
+		t.Fatalf("the session moved before its TTL")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if s.Client() == first {
+		t.Fatalf("the session didn't move after its TTL")
+	}
+	if n := len(pool.sessions.pins); n != 1 {
+		t.Fatalf("expected 1 pinned session, got %d", n)
+	}
+}
@@ -0,0 +1,337 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/valyala/fasthttp"
+)
+
+// SessionCache is a TLS session cache and QUIC token store that several
+// clients can share, so that a connection made by one of them lets the
+// others resume the session (and send 0-RTT data) instead of doing a full
+// handshake. Sessions are only resumed through the proxies they were made
+// through, see SetSessionCache.
+type SessionCache struct {
+	sessions tls.ClientSessionCache
+	tokens   quic.TokenStore
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	tokenHits   atomic.Uint64
+	tokenMisses atomic.Uint64
+}
+
+// SessionCacheStats counts lookups in a SessionCache.
+type SessionCacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	TokenHits   uint64
+	TokenMisses uint64
+}
+
+// NewSessionCache returns a SessionCache holding up to capacity TLS sessions
+// (64 if capacity <= 0) and QUIC tokens for as many origins.
+func NewSessionCache(capacity int) *SessionCache {
+	if capacity <= 0 {
+		capacity = 64
+	}
+	return &SessionCache{
+		sessions: tls.NewLRUClientSessionCache(capacity),
+		tokens:   quic.NewLRUTokenStore(capacity, 4),
+	}
+}
+
+// Get returns the TLS session stored under sessionKey, counting a hit or a
+// miss. With Put, it makes SessionCache a tls.ClientSessionCache; set in a
+// tls.Config directly, it keys sessions by server only, whatever the proxy.
+func (s *SessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	cs, ok := s.sessions.Get(sessionKey)
+	if ok {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+	return cs, ok
+}
+
+// Put stores cs under sessionKey; a nil cs removes the session.
+func (s *SessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	s.sessions.Put(sessionKey, cs)
+}
+
+// Stats returns the lookups made so far.
+func (s *SessionCache) Stats() SessionCacheStats {
+	return SessionCacheStats{
+		Hits:        s.hits.Load(),
+		Misses:      s.misses.Load(),
+		TokenHits:   s.tokenHits.Load(),
+		TokenMisses: s.tokenMisses.Load(),
+	}
+}
+
+// sessionTokenStore counts QUIC token lookups.
+type sessionTokenStore SessionCache
+
+func (s *sessionTokenStore) Pop(key string) *quic.ClientToken {
+	token := s.tokens.Pop(key)
+	if token != nil {
+		s.tokenHits.Add(1)
+	} else {
+		s.tokenMisses.Add(1)
+	}
+	return token
+}
+
+func (s *sessionTokenStore) Put(key string, token *quic.ClientToken) {
+	s.tokens.Put(key, token)
+}
+
+// clientSessions is the view of a SessionCache a client's TLS and QUIC
+// configs hold. It keys sessions and tokens by the proxies the connection
+// goes through: a ticket resumed through another proxy would tell the server
+// that both exit IPs are the same client. TLS 1.3 tickets can arrive long
+// after the handshake, so each connection gets a view bound to its proxies
+// when it is dialed (see sessionsThrough).
+type clientSessions struct {
+	sc *SessionCache
+	c  *Client
+	// prefix is the key prefix of a bound view; an unbound one looks up the
+	// client's proxies on every use.
+	prefix string
+	bound  bool
+}
+
+func (s *clientSessions) key(key string) string {
+	if s.bound {
+		return s.prefix + key
+	}
+	return s.c.sessionPrefix() + key
+}
+
+// sessionPrefix is the key prefix of the sessions of connections the client
+// makes with its own proxy settings.
+func (c *Client) sessionPrefix() string {
+	t := c.current()
+	if t.proxies == nil && t.dial != nil {
+		// Proxy rules and the environment pick the proxy per connection:
+		// keep the sessions to the client.
+		return fmt.Sprintf("%p|", c)
+	}
+	return proxiesSessionPrefix(t.proxies)
+}
+
+func proxiesSessionPrefix(proxies []ProxySpec) string {
+	var b strings.Builder
+	for i := range proxies {
+		if proxies[i].Scheme != "" {
+			b.WriteString(proxyPoolKey(&proxies[i]))
+		}
+	}
+	return b.String()
+}
+
+func (s *clientSessions) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return s.sc.Get(s.key(sessionKey))
+}
+
+func (s *clientSessions) Put(sessionKey string, cs *tls.ClientSessionState) {
+	s.sc.Put(s.key(sessionKey), cs)
+}
+
+// clientTokens is the QUIC token store of a clientSessions.
+type clientTokens clientSessions
+
+func (s *clientTokens) Pop(key string) *quic.ClientToken {
+	return (*sessionTokenStore)(s.sc).Pop((*clientSessions)(s).key(key))
+}
+
+func (s *clientTokens) Put(key string, token *quic.ClientToken) {
+	(*sessionTokenStore)(s.sc).Put((*clientSessions)(s).key(key), token)
+}
+
+// SetSessionCache makes the client resume TLS sessions and QUIC connections
+// through sc. Call it before making requests.
+//
+// Sessions and tokens are kept apart per proxy: clients going through the
+// same proxies (or none) share them, while a client behind another proxy,
+// or a request sent through another proxy with WithProxy or SetProxyPAC,
+// starts afresh. Resuming a session across proxies would let the server
+// link their exit IPs. A client routed by SetProxyRules or the environment
+// keeps its sessions to itself.
+func (c *Client) SetSessionCache(sc *SessionCache) {
+	if c == nil || sc == nil {
+		return
+	}
+	sessions := &clientSessions{sc: sc, c: c}
+	c.TLSConfig = withSessionCache(c.TLSConfig, sessions)
+	// fasthttp and net/http build a connection's TLS config from their own,
+	// so the client makes their TLS connections itself.
+	configure := c.Client.ConfigureClient
+	c.Client.ConfigureClient = func(hc *fasthttp.HostClient) error {
+		if configure != nil {
+			if err := configure(hc); err != nil {
+				return err
+			}
+		}
+		if hc.IsTLS {
+			hc.Dial = c.hostClientTLSDialer(hc)
+		}
+		return nil
+	}
+	if tr := trFromHTTPClient(c.httpClient); tr != nil {
+		tr.TLSClientConfig = withSessionCache(tr.TLSClientConfig, sessions)
+		tr.Proxy = c.netHTTPPlainProxy
+		tr.DialTLSContext = c.netHTTPTLSDialer(tr.TLSClientConfig)
+	}
+	if c.httpClient == nil {
+		return
+	}
+	if h3, ok := c.httpClient.Transport.(*http3.Transport); ok {
+		h3.TLSClientConfig = withSessionCache(h3.TLSClientConfig, sessions)
+		if h3.QUICConfig == nil {
+			h3.QUICConfig = &quic.Config{}
+		}
+		h3.QUICConfig.TokenStore = (*clientTokens)(sessions)
+		// The racer dials QUIC with the configs it was made with.
+		c.updateTransports(func(t *clientTransports) {
+			if t.race != nil {
+				t.race = newH3Racer(c, t.h2, c.h3RaceDelay)
+				t.h3Dial = t.race.dialH3
+			}
+		})
+	}
+}
+
+// hostClientTLSDialer returns the dialer of hc, a fasthttp client of a TLS
+// host, that makes the TLS connection with sessions bound at dial time.
+func (c *Client) hostClientTLSDialer(hc *fasthttp.HostClient) fasthttp.DialFunc {
+	dial := hc.Dial
+	if dial == nil {
+		dial = c.dialFasthttp
+	}
+	tlsConfig, timeout := hc.TLSConfig, hc.WriteTimeout
+	return func(addr string) (net.Conn, error) {
+		cfg := clientTLSConfig(sessionsThrough(tlsConfig, nil), addr)
+		if cfg.ServerName == "" {
+			// Like fasthttp, which names the server even without
+			// verifying it.
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return dialTLS(ctx, func(context.Context, string, string) (net.Conn, error) {
+			return dial(addr)
+		}, addr, cfg)
+	}
+}
+
+// netHTTPPlainProxy is the Proxy of a net/http transport whose TLS
+// connections the client makes: https requests are tunnelled by
+// netHTTPTLSDialer instead.
+func (c *Client) netHTTPPlainProxy(req *http.Request) (*url.URL, error) {
+	if req.URL.Scheme == "https" {
+		return nil, nil
+	}
+	return c.netHTTPProxy(req)
+}
+
+// netHTTPTLSDialer returns the DialTLSContext of a net/http transport with
+// TLS config cfg, that dials through the client's proxies with sessions
+// bound at dial time.
+func (c *Client) netHTTPTLSDialer(cfg *tls.Config) dialContextFunc {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		tlsConfig := clientTLSConfig(sessionsThrough(cfg, nil), addr, "h2", "http/1.1")
+		dial := c.current().dial
+		if dial == nil {
+			dial = netHTTPDialer.DialContext
+		}
+		return dialTLS(ctx, dial, addr, tlsConfig)
+	}
+}
+
+// SetSessionCache shares sc between all clients of the pool.
+func (p *ClientPool) SetSessionCache(sc *SessionCache) {
+	if p == nil {
+		return
+	}
+	for _, m := range p.memberList() {
+		m.client.SetSessionCache(sc)
+	}
+}
+
+func withSessionCache(cfg *tls.Config, sc tls.ClientSessionCache) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	cfg.ClientSessionCache = sc
+	return cfg
+}
+
+// sessionsThrough returns cfg for a connection being dialed, with its
+// sessions bound to p, a proxy set with WithProxy, or to the client's
+// current proxies if p is nil. cfg is returned as is if it doesn't hold a
+// client's view of a SessionCache or, for a nil p, is bound already.
+func sessionsThrough(cfg *tls.Config, p *ProxySpec) *tls.Config {
+	if cfg == nil {
+		return cfg
+	}
+	s, ok := cfg.ClientSessionCache.(*clientSessions)
+	if !ok || (p == nil && s.bound) {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.ClientSessionCache = s.through(p)
+	return cfg
+}
+
+// sessionsVia returns cfg for a connection through proxies, with its
+// sessions bound to them.
+func sessionsVia(cfg *tls.Config, proxies []ProxySpec) *tls.Config {
+	if cfg == nil {
+		return cfg
+	}
+	s, ok := cfg.ClientSessionCache.(*clientSessions)
+	if !ok {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.ClientSessionCache = &clientSessions{sc: s.sc, c: s.c, prefix: proxiesSessionPrefix(proxies), bound: true}
+	return cfg
+}
+
+// tokensThrough is sessionsThrough for the QUIC tokens of cfg.
+func tokensThrough(cfg *quic.Config, p *ProxySpec) *quic.Config {
+	if cfg == nil {
+		return cfg
+	}
+	s, ok := cfg.TokenStore.(*clientTokens)
+	if !ok || (p == nil && s.bound) {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.TokenStore = (*clientTokens)((*clientSessions)(s).through(p))
+	return cfg
+}
+
+func (s *clientSessions) through(p *ProxySpec) *clientSessions {
+	prefix := s.c.sessionPrefix()
+	if p != nil {
+		prefix = proxiesSessionPrefix([]ProxySpec{*p})
+	}
+	return &clientSessions{sc: s.sc, c: s.c, prefix: prefix, bound: true}
+}
@@ -0,0 +1,159 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+)
+
+func TestSessionCacheSharedAcrossPool(t *testing.T) {
+	for _, version := range []HTTPVersion{HTTP1, HTTP2, HTTP3} {
+		base, _ := newTestServerForVersion(t, version, protoEchoHandler())
+		sc := NewSessionCache(0)
+		p := NewClientPool(3, func() *Client {
+			return NewClientWithOptions(ClientOptions{
+				HTTPVersion:  version,
+				TLSConfig:    testClientTLSConfig(),
+				SessionCache: sc,
+			})
+		})
+
+		for i := 0; i < 3; i++ {
+			if _, _, err := p.Next().GetBytes(base); err != nil {
+				t.Fatalf("%v: request %d: %v", version, i, err)
+			}
+		}
+		for _, m := range p.memberList() {
+			m.client.CloseIdleConnections()
+		}
+
+		st := sc.Stats()
+		if st.Misses != 1 || st.Hits != 2 {
+			t.Fatalf("%v: expected 1 full handshake and 2 resumptions, got %+v", version, st)
+		}
+		if version == HTTP3 && st.TokenHits == 0 {
+			t.Fatalf("%v: expected QUIC tokens to be reused, got %+v", version, st)
+		}
+	}
+}
+
+func TestClientPoolSetSessionCache(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	p := NewHighPerfClientPool(2, "")
+	sc := NewSessionCache(0)
+	p.SetSessionCache(sc)
+
+	for _, m := range p.memberList() {
+		c := m.client
+		if s, ok := c.TLSConfig.ClientSessionCache.(*clientSessions); !ok || s.sc != sc {
+			t.Fatalf("expected the shared cache on every client")
+		}
+		c.TLSConfig.InsecureSkipVerify = true
+		if _, _, err := c.GetBytes(srv.URL); err != nil {
+			t.Fatalf("GetBytes: %v", err)
+		}
+		c.CloseIdleConnections()
+	}
+	if st := sc.Stats(); st.Hits != 1 {
+		t.Fatalf("expected the second client to resume, got %+v", st)
+	}
+}
+
+// TestSessionCacheKeptApartPerProxy checks that a session made through one
+// proxy is only resumed through that proxy.
+func TestSessionCacheKeptApartPerProxy(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	a := newTestHTTPProxy(t, false, "")
+	b := newTestHTTPProxy(t, false, "")
+	sc := NewSessionCache(0)
+	newClient := func(proxy string) *Client {
+		return NewClientWithOptions(ClientOptions{
+			HTTPVersion: HTTP1,
+			// The fasthttp and context-bound paths name the server alike.
+			TLSConfig:    &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"},
+			ProxyHTTP:    proxy,
+			SessionCache: sc,
+		})
+	}
+	ca, ca2, cb := newClient(a.URL("")), newClient(a.URL("")), newClient(b.URL(""))
+	viaB, err := ParseProxy(b.URL(""))
+	if err != nil {
+		t.Fatalf("ParseProxy: %v", err)
+	}
+
+	steps := []struct {
+		name string
+		c    *Client
+		ctx  context.Context
+		hits uint64
+	}{
+		{"first through a", ca, context.Background(), 0},
+		{"second through a", ca2, context.Background(), 1},
+		{"first through b", cb, context.Background(), 1},
+		{"WithProxy b", ca, WithProxy(context.Background(), viaB), 2},
+		{"WithProxy direct", ca, WithProxy(context.Background(), ProxySpec{}), 2},
+	}
+	for _, step := range steps {
+		var req Request
+		var resp Response
+		req.SetRequestURI(srv.URL + "/")
+		if err := step.c.DoCtx(step.ctx, &req, &resp); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		step.c.CloseIdleConnections()
+		if st := sc.Stats(); st.Hits != step.hits {
+			t.Fatalf("%s: expected %d resumptions, got %+v", step.name, step.hits, st)
+		}
+	}
+}
+
+// TestSessionCacheKeyFixedAtDial checks that a ticket arriving after a proxy
+// change is kept for the proxy its connection went through.
+func TestSessionCacheKeyFixedAtDial(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	a := newTestHTTPProxy(t, false, "")
+	b := newTestHTTPProxy(t, false, "")
+	for _, tc := range []struct {
+		name string
+		opt  ClientOptions
+	}{
+		{"HTTP1", ClientOptions{HTTPVersion: HTTP1}},
+		{"HTTP2", ClientOptions{HTTPVersion: HTTP2}},
+		{"net/http", ClientOptions{HTTPVersion: HTTP2, DisableNativeHTTP2: true}},
+	} {
+		sc := NewSessionCache(0)
+		newClient := func(verify func(tls.ConnectionState) error) *Client {
+			opt := tc.opt
+			opt.TLSConfig = &tls.Config{InsecureSkipVerify: true, ServerName: "localhost", VerifyConnection: verify}
+			opt.ProxyHTTP = a.URL("")
+			opt.SessionCache = sc
+			return NewClientWithOptions(opt)
+		}
+		var c *Client
+		var once sync.Once
+		// The ticket comes after the handshake, once the proxy changed.
+		c = newClient(func(tls.ConnectionState) error {
+			once.Do(func() { _ = c.SetProxyHTTP(b.URL("")) })
+			return nil
+		})
+		steps := []struct {
+			name string
+			c    *Client
+			hits uint64
+		}{
+			{"first through a", c, 0},
+			{"then through b", c, 0},
+			{"another client through a", newClient(nil), 1},
+		}
+		for _, step := range steps {
+			if _, _, err := step.c.GetBytes(srv.URL + "/"); err != nil {
+				t.Fatalf("%s: %s: %v", tc.name, step.name, err)
+			}
+			step.c.CloseIdleConnections()
+			if st := sc.Stats(); st.Hits != step.hits {
+				t.Fatalf("%s: %s: expected %d resumptions, got %+v", tc.name, step.name, step.hits, st)
+			}
+		}
+	}
+}
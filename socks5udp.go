@@ -0,0 +1,358 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// HTTP/3 through SOCKS5: every QUIC connection gets its own UDP ASSOCIATE
+// (RFC 1928) and a net.PacketConn that wraps datagrams in the SOCKS5 UDP
+// request header on their way to the proxy's relay.
+
+var ErrProxyUDPUnsupported = errors.New("proxy does not support UDP")
+
+type socks5UDPDialer struct {
+	proxyAddr string
+	user      string
+	password  string
+	forward   dialContextFunc
+	// remoteDNS sends host names to the proxy (socks5h).
+	remoteDNS bool
+}
+
+func newSOCKS5UDPDialer(p ProxySpec, forward dialContextFunc) *socks5UDPDialer {
+	return &socks5UDPDialer{
+		proxyAddr: p.Addr,
+		user:      p.Username,
+		password:  p.Password,
+		forward:   forward,
+		remoteDNS: p.Scheme == "socks5h",
+	}
+}
+
+// socks5DomainAddr is a UDP target named by host name, for the proxy to
+// resolve.
+type socks5DomainAddr struct {
+	host string
+	port int
+}
+
+func (a *socks5DomainAddr) Network() string { return "udp" }
+func (a *socks5DomainAddr) String() string  { return net.JoinHostPort(a.host, strconv.Itoa(a.port)) }
+
+// dialQUIC is the http3.Transport dialer for SOCKS5 proxies.
+func (d *socks5UDPDialer) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	raddr, err := d.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := d.associate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc.target, _ = raddr.(*socks5DomainAddr)
+	tr := &quic.Transport{Conn: pc}
+	conn, err := tr.DialEarly(ctx, raddr, tlsCfg, cfg)
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, err
+	}
+	context.AfterFunc(conn.Context(), func() {
+		tr.Close()
+		pc.Close()
+	})
+	return conn, nil
+}
+
+// resolve returns the address datagrams to addr are sent to: addr's host
+// name as is with socks5h, its IP address otherwise.
+func (d *socks5UDPDialer) resolve(addr string) (net.Addr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !d.remoteDNS || net.ParseIP(host) != nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("socks5: host name %q is too long", host)
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	return &socks5DomainAddr{host: host, port: port}, nil
+}
+
+func (d *socks5UDPDialer) associate(ctx context.Context) (*socks5PacketConn, error) {
+	ctrl, err := d.forward(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchConn(ctx, ctrl)
+	relay, err := d.handshake(ctrl)
+	if !stop() {
+		ctrl.Close()
+		return nil, ctxError(ctx, err)
+	}
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// The relay listens on the address we reached the proxy at.
+		host, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+		if ip := net.ParseIP(host); ip != nil {
+			relay.IP = ip
+		}
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	pc := &socks5PacketConn{udp: udp, ctrl: ctrl, relay: relay}
+	go func() {
+		// The association lives as long as the control connection.
+		_, _ = io.Copy(io.Discard, ctrl)
+		pc.Close()
+	}()
+	return pc, nil
+}
+
+func (d *socks5UDPDialer) handshake(conn net.Conn) (*net.UDPAddr, error) {
+	methods := []byte{5, 1, 0}
+	if d.user != "" {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return nil, err
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return nil, err
+	}
+	if buf[0] != 5 {
+		return nil, fmt.Errorf("socks5: unexpected protocol version %d", buf[0])
+	}
+	switch buf[1] {
+	case 0:
+	case 2:
+		if d.user == "" {
+			return nil, errors.New("socks5: proxy requires authentication")
+		}
+		if len(d.user) > 255 || len(d.password) > 255 {
+			return nil, errors.New("socks5: user name or password longer than 255 bytes")
+		}
+		auth := []byte{1, byte(len(d.user))}
+		auth = append(auth, d.user...)
+		auth = append(auth, byte(len(d.password)))
+		auth = append(auth, d.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, errors.New("socks5: username/password authentication failed")
+		}
+	default:
+		return nil, errors.New("socks5: no acceptable authentication methods")
+	}
+
+	// UDP ASSOCIATE from an address we don't know yet.
+	if _, err := conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	var head [3]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		return nil, fmt.Errorf("%w: socks5 UDP ASSOCIATE failed: %s", ErrProxyUDPUnsupported, socks5ReplyText(head[1]))
+	}
+	host, port, err := readSOCKS5Addr(conn)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return nil, err
+		}
+		return addr, nil
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+func readSOCKS5Addr(r io.Reader) (host string, port int, err error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var b []byte
+	switch atyp[0] {
+	case 1:
+		b = make([]byte, net.IPv4len+2)
+	case 4:
+		b = make([]byte, net.IPv6len+2)
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		b = make([]byte, int(n[0])+2)
+	default:
+		return "", 0, fmt.Errorf("socks5: unknown address type %d", atyp[0])
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", 0, err
+	}
+	port = int(binary.BigEndian.Uint16(b[len(b)-2:]))
+	if atyp[0] == 3 {
+		return string(b[:len(b)-2]), port, nil
+	}
+	return net.IP(b[:len(b)-2]).String(), port, nil
+}
+
+func socks5ReplyText(code byte) string {
+	switch code {
+	case 1:
+		return "general SOCKS server failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 7:
+		return "command not supported"
+	}
+	return "reply code " + strconv.Itoa(int(code))
+}
+
+// socks5PacketConn deliberately doesn't expose the *net.UDPConn methods, so
+// that quic-go goes through ReadFrom/WriteTo.
+type socks5PacketConn struct {
+	udp   *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+	// target is the host name datagrams are sent to with socks5h.
+	target *socks5DomainAddr
+
+	rmu  sync.Mutex
+	rbuf []byte
+	wmu  sync.Mutex
+	wbuf []byte
+
+	closeOnce sync.Once
+}
+
+func (c *socks5PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, 64<<10)
+	}
+	for {
+		n, from, err := c.udp.ReadFromUDP(c.rbuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+		addr, payload, ok := parseSOCKS5UDP(c.rbuf[:n])
+		if !ok {
+			continue
+		}
+		if c.target != nil {
+			// quic-go expects the address it dialed.
+			addr = c.target
+		}
+		return copy(p, payload), addr, nil
+	}
+}
+
+func (c *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	b := append(c.wbuf[:0], 0, 0, 0)
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			b = append(b, 1)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, 4)
+			b = append(b, addr.IP.To16()...)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+	case *socks5DomainAddr:
+		b = append(b, 3, byte(len(addr.host)))
+		b = append(b, addr.host...)
+		b = binary.BigEndian.AppendUint16(b, uint16(addr.port))
+	default:
+		return 0, fmt.Errorf("socks5: unsupported address %v", addr)
+	}
+	b = append(b, p...)
+	c.wbuf = b
+	if _, err := c.udp.WriteToUDP(b, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// parseSOCKS5UDP strips the UDP request header, returning the address it
+// holds: a *net.UDPAddr, or a *socks5DomainAddr. Fragments are dropped, as
+// RFC 1928 allows.
+func parseSOCKS5UDP(b []byte) (net.Addr, []byte, bool) {
+	if len(b) < 5 || b[2] != 0 {
+		return nil, nil, false
+	}
+	start, end := 4, 0
+	switch b[3] {
+	case 1:
+		end = start + net.IPv4len
+	case 4:
+		end = start + net.IPv6len
+	case 3:
+		start++
+		end = start + int(b[4])
+	default:
+		return nil, nil, false
+	}
+	if len(b) < end+2 {
+		return nil, nil, false
+	}
+	port := int(binary.BigEndian.Uint16(b[end:]))
+	if b[3] == 3 {
+		return &socks5DomainAddr{host: string(b[start:end]), port: port}, b[end+2:], true
+	}
+	ip := make(net.IP, end-start)
+	copy(ip, b[start:end])
+	return &net.UDPAddr{IP: ip, Port: port}, b[end+2:], true
+}
+
+func (c *socks5PacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.ctrl.Close()
+		err = c.udp.Close()
+	})
+	return err
+}
+
+func (c *socks5PacketConn) LocalAddr() net.Addr                { return c.udp.LocalAddr() }
+func (c *socks5PacketConn) SetDeadline(t time.Time) error      { return c.udp.SetDeadline(t) }
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) error  { return c.udp.SetReadDeadline(t) }
+func (c *socks5PacketConn) SetWriteDeadline(t time.Time) error { return c.udp.SetWriteDeadline(t) }
@@ -0,0 +1,101 @@
+package v2fasthttp
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHTTP3OverSOCKS5UDPAssociate(t *testing.T) {
+	base := newTestH3Server(t, protoEchoHandler())
+	proxy := newTestSOCKS5Server(t, false)
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP3,
+		TLSConfig:   testClientTLSConfig(),
+		SOCKS5Proxy: proxy.URL(),
+	})
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		body, info := doWithInfo(t, c, base)
+		if body != "HTTP/3.0" || info.Protocol != "HTTP/3.0" || info.Downgraded {
+			t.Fatalf("request %d: body %q, info %+v", i, body, info)
+		}
+	}
+	if n := proxy.associates.Load(); n != 1 {
+		t.Fatalf("expected 1 UDP association, got %d", n)
+	}
+	if proxy.datagrams.Load() == 0 {
+		t.Fatalf("expected datagrams to be relayed by the proxy")
+	}
+	if err := c.HTTP3Downgrade(); err != nil {
+		t.Fatalf("unexpected downgrade: %v", err)
+	}
+}
+
+// TestHTTP3OverSOCKS5hSendsHostNames checks that with socks5h the relay,
+// not the client, resolves the host name of the target.
+func TestHTTP3OverSOCKS5hSendsHostNames(t *testing.T) {
+	base := newTestH3Server(t, protoEchoHandler())
+	_, port, _ := net.SplitHostPort(base[len("https://"):])
+	proxy := newTestSOCKS5Server(t, false)
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP3,
+		TLSConfig:   testClientTLSConfig(),
+		SOCKS5Proxy: "socks5h://" + proxy.ln.Addr().String(),
+	})
+	defer c.CloseIdleConnections()
+
+	if body, info := doWithInfo(t, c, "https://localhost:"+port); body != "HTTP/3.0" || info.Downgraded {
+		t.Fatalf("body %q, info %+v", body, info)
+	}
+	if target := proxy.udpTarget.Load(); target == nil || *target != "localhost:"+port {
+		t.Fatalf("the relay was sent %v, want localhost:%s", target, port)
+	}
+}
+
+func TestHTTP3OverSOCKS5DowngradesWhenUDPRefused(t *testing.T) {
+	srv := newTestH2Server(t, protoEchoHandler())
+	proxy := newTestSOCKS5Server(t, true)
+
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: HTTP3,
+		TLSConfig:   testClientTLSConfig(),
+		SOCKS5Proxy: proxy.URL(),
+	})
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		body, info := doWithInfo(t, c, srv.URL)
+		if body != "HTTP/2.0" || info.Protocol != "HTTP/2.0" || !info.Downgraded {
+			t.Fatalf("request %d: body %q, info %+v", i, body, info)
+		}
+	}
+	if err := c.HTTP3Downgrade(); !errors.Is(err, ErrProxyUDPUnsupported) {
+		t.Fatalf("HTTP3Downgrade() = %v", err)
+	}
+	if proxy.connects.Load() == 0 {
+		t.Fatalf("expected the HTTP/2 fallback to go through the proxy")
+	}
+}
+
+func TestParseSOCKS5UDP(t *testing.T) {
+	b := []byte{0, 0, 0, 1, 10, 0, 0, 1, 0x01, 0xbb, 'h', 'i'}
+	addr, payload, ok := parseSOCKS5UDP(b)
+	if !ok || addr.String() != "10.0.0.1:443" || string(payload) != "hi" {
+		t.Fatalf("parseSOCKS5UDP = %v, %q, %v", addr, payload, ok)
+	}
+	b = []byte{0, 0, 0, 3, 4, 'h', 'o', 's', 't', 0x01, 0xbb, 'h', 'i'}
+	addr, payload, ok = parseSOCKS5UDP(b)
+	if _, isDomain := addr.(*socks5DomainAddr); !ok || !isDomain || addr.String() != "host:443" || string(payload) != "hi" {
+		t.Fatalf("parseSOCKS5UDP = %v, %q, %v", addr, payload, ok)
+	}
+	if _, _, ok := parseSOCKS5UDP([]byte{0, 0, 0, 3, 9, 'h', 'o', 's', 't'}); ok {
+		t.Fatalf("expected a truncated header to be dropped")
+	}
+	if _, _, ok := parseSOCKS5UDP([]byte{0, 0, 1, 1, 10, 0, 0, 1, 0, 80}); ok {
+		t.Fatalf("expected fragments to be dropped")
+	}
+}
@@ -0,0 +1,477 @@
+package v2fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// testSOCKS5Server is a minimal SOCKS5 proxy supporting CONNECT and, unless
+// refuseUDP is set, UDP ASSOCIATE. It requires username/password
+// authentication when user is set.
+type testSOCKS5Server struct {
+	ln        net.Listener
+	refuseUDP bool
+	user      string
+	password  string
+
+	connects   atomic.Int32
+	associates atomic.Int32
+	datagrams  atomic.Int32
+	// target is the host of the last CONNECT, as the client sent it.
+	target atomic.Pointer[string]
+	// udpTarget is the host:port of the last datagram, as the client sent
+	// it.
+	udpTarget atomic.Pointer[string]
+}
+
+func newTestSOCKS5Server(t testing.TB, refuseUDP bool) *testSOCKS5Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &testSOCKS5Server{ln: ln, refuseUDP: refuseUDP}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *testSOCKS5Server) URL() string {
+	return "socks5://" + s.ln.Addr().String()
+}
+
+func (s *testSOCKS5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if s.user != "" {
+		if !bytes.Contains(methods, []byte{2}) {
+			_, _ = conn.Write([]byte{5, 0xff})
+			return
+		}
+		if _, err := conn.Write([]byte{5, 2}); err != nil {
+			return
+		}
+		user, password, err := readSOCKS5Auth(conn)
+		if err != nil {
+			return
+		}
+		if user != s.user || password != s.password {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return
+		}
+	} else if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	host, port, err := readSOCKS5Addr(conn)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case 1:
+		s.connects.Add(1)
+		s.target.Store(&host)
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(target, conn)
+			target.Close()
+		}()
+		_, _ = io.Copy(conn, target)
+	case 3:
+		if s.refuseUDP {
+			_, _ = conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		s.associates.Add(1)
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		out, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer out.Close()
+		reply := []byte{5, 0, 0, 1}
+		reply = append(reply, net.IPv4(127, 0, 0, 1).To4()...)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+		go s.relayUDP(relay, out)
+		_, _ = io.Copy(io.Discard, conn)
+	default:
+		_, _ = conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func readSOCKS5Auth(r io.Reader) (user, password string, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", "", err
+	}
+	b := make([]byte, int(head[1])+1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", "", err
+	}
+	user = string(b[:head[1]])
+	b = make([]byte, b[head[1]])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", "", err
+	}
+	return user, string(b), nil
+}
+
+func (s *testSOCKS5Server) relayUDP(relay, out *net.UDPConn) {
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := out.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			to := client.Load()
+			if to == nil {
+				continue
+			}
+			b := []byte{0, 0, 0, 1}
+			b = append(b, from.IP.To4()...)
+			b = binary.BigEndian.AppendUint16(b, uint16(from.Port))
+			b = append(b, buf[:n]...)
+			_, _ = relay.WriteToUDP(b, to)
+		}
+	}()
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		dst, payload, ok := parseSOCKS5UDP(buf[:n])
+		if !ok {
+			continue
+		}
+		target := dst.String()
+		s.udpTarget.Store(&target)
+		to, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			continue
+		}
+		client.Store(from)
+		s.datagrams.Add(1)
+		_, _ = out.WriteToUDP(payload, to)
+	}
+}
+
+// testSOCKS4Server is a minimal SOCKS4 and SOCKS4a proxy. It rejects
+// requests whose user ID isn't userID.
+type testSOCKS4Server struct {
+	ln     net.Listener
+	userID string
+
+	connects atomic.Int32
+	// target is the host of the last CONNECT: an IP, or the name a SOCKS4a
+	// client sent.
+	target atomic.Pointer[string]
+}
+
+func newTestSOCKS4Server(t testing.TB, userID string) *testSOCKS4Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &testSOCKS4Server{ln: ln, userID: userID}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *testSOCKS4Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testSOCKS4Server) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var req [8]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil || req[0] != 4 || req[1] != 1 {
+		return
+	}
+	userID, err := br.ReadString(0)
+	if err != nil {
+		return
+	}
+	host := net.IP(req[4:8]).String()
+	if req[4] == 0 && req[5] == 0 && req[6] == 0 && req[7] != 0 {
+		if host, err = br.ReadString(0); err != nil {
+			return
+		}
+		host = strings.TrimSuffix(host, "\x00")
+	}
+	if strings.TrimSuffix(userID, "\x00") != s.userID {
+		_, _ = conn.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	s.connects.Add(1)
+	s.target.Store(&host)
+	port := binary.BigEndian.Uint16(req[2:4])
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		_, _ = conn.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	go func() {
+		_, _ = io.Copy(target, conn)
+		target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+// testHTTPProxy is a minimal CONNECT proxy, behind TLS when tls is set. It
+// requires Basic credentials when auth ("user:pass") is set, and drops every
+// connection while down is set.
+type testHTTPProxy struct {
+	ln   net.Listener
+	tls  bool
+	auth string
+	down atomic.Bool
+
+	connects atomic.Int32
+	// target is the host:port of the last CONNECT.
+	target atomic.Pointer[string]
+}
+
+func newTestHTTPProxy(t testing.TB, useTLS bool, auth string) *testHTTPProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &testHTTPProxy{ln: ln, tls: useTLS, auth: auth}
+	if useTLS {
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+// URL returns the proxy URL with userinfo, if any, in front of the address.
+func (s *testHTTPProxy) URL(userinfo string) string {
+	scheme := "http://"
+	if s.tls {
+		scheme = "https://"
+	}
+	if userinfo != "" {
+		userinfo += "@"
+	}
+	return scheme + userinfo + s.ln.Addr().String()
+}
+
+func (s *testHTTPProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	if s.down.Load() {
+		return
+	}
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	if s.auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(s.auth)) {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	s.connects.Add(1)
+	s.target.Store(&req.Host)
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	go func() {
+		_, _ = io.Copy(target, br)
+		target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+// testMASQUEServer is a minimal CONNECT-UDP (RFC 9298) proxy using the
+// default URI template. It answers with status instead of 200 when set.
+type testMASQUEServer struct {
+	addr   string
+	status int
+	auth   string
+
+	tunnels   atomic.Int32
+	datagrams atomic.Int32
+}
+
+func newTestMASQUEServer(t testing.TB, status int) *testMASQUEServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	s := &testMASQUEServer{addr: pc.LocalAddr().String(), status: status}
+	srv := &http3.Server{
+		Handler:         http.HandlerFunc(s.serveHTTP),
+		EnableDatagrams: true,
+		QUICConfig:      &quic.Config{InitialPacketSize: masqueOuterPacketSize},
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{testCertificate(t)},
+		}),
+	}
+	go func() { _ = srv.Serve(pc) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = pc.Close()
+	})
+	return s
+}
+
+func (s *testMASQUEServer) URL() string {
+	return "masque://" + s.addr
+}
+
+func (s *testMASQUEServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect || r.Proto != "connect-udp" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if s.auth != "" && r.Header.Get("Proxy-Authorization") != s.auth {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/.well-known/masque/udp/"), "/")
+	if len(parts) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	target, err := net.Dial("udp", net.JoinHostPort(parts[0], parts[1]))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	s.tunnels.Add(1)
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	str := w.(http3.HTTPStreamer).HTTPStream()
+	defer str.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := target.Read(buf)
+			if err != nil {
+				return
+			}
+			b := append(quicvarint.Append(nil, 0), buf[:n]...)
+			if err := str.SendDatagram(b); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		// The stream closing ends the tunnel.
+		_, _ = io.Copy(io.Discard, str)
+		cancel()
+	}()
+	for {
+		b, err := str.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		contextID, n, err := quicvarint.Parse(b)
+		if err != nil || contextID != 0 {
+			continue
+		}
+		s.datagrams.Add(1)
+		_, _ = target.Write(b[n:])
+	}
+}
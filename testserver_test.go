@@ -0,0 +1,357 @@
+package v2fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/qpack"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var (
+	testCertOnce sync.Once
+	testCert     tls.Certificate
+	testCertErr  error
+)
+
+func testCertificate(t testing.TB) tls.Certificate {
+	t.Helper()
+	testCertOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+		testCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	if testCertErr != nil {
+		t.Fatalf("generate test certificate: %v", testCertErr)
+	}
+	return testCert
+}
+
+func testClientTLSConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true}
+}
+
+// newTestH2Server starts a TLS server that negotiates h2 via ALPN and falls
+// back to HTTP/1.1 for clients that don't offer it (such as fasthttp).
+func newTestH2Server(t testing.TB, h http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestH2CServer starts a plain-TCP server that speaks HTTP/1.1 and, with
+// prior knowledge, HTTP/2.
+func newTestH2CServer(t testing.TB, h http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestH3Server starts an HTTP/3 server on a loopback UDP socket and
+// returns its base URL.
+func newTestH3Server(t testing.TB, h http.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	srv := &http3.Server{
+		Handler: h,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{testCertificate(t)},
+		}),
+	}
+	go func() { _ = srv.Serve(pc) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = pc.Close()
+	})
+	return "https://" + pc.LocalAddr().String()
+}
+
+// newTestServerForVersion returns the base URL of a local server that speaks
+// the given version, and a client configured for it.
+func newTestServerForVersion(t testing.TB, version HTTPVersion, h http.Handler) (string, *Client) {
+	t.Helper()
+	c := NewClientWithOptions(ClientOptions{
+		HTTPVersion: version,
+		TLSConfig:   testClientTLSConfig(),
+	})
+	if version == HTTP3 {
+		return newTestH3Server(t, h), c
+	}
+	return newTestH2Server(t, h).URL, c
+}
+
+// protoEchoHandler replies with the request protocol in the body, handles
+// /redirect by redirecting to /final and echoes form values on POST.
+func protoEchoHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/final", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		_, _ = w.Write([]byte(r.Proto))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Path", r.URL.Path)
+		if r.Method == http.MethodPost {
+			_ = r.ParseForm()
+			_, _ = w.Write([]byte(r.Proto + " " + r.PostForm.Encode()))
+			return
+		}
+		_, _ = w.Write([]byte(r.Proto))
+	})
+	return mux
+}
+
+// newTestRawHTTP1Server accepts plain HTTP/1.1 requests without a body and
+// sends the header lines of each one, as they were on the wire, to the
+// returned channel.
+func newTestRawHTTP1Server(t testing.TB) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan []string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					if _, err := br.ReadString('\n'); err != nil {
+						return
+					}
+					var lines []string
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return
+						}
+						line = strings.TrimRight(line, "\r\n")
+						if line == "" {
+							break
+						}
+						lines = append(lines, line)
+					}
+					requests <- lines
+					if _, err := io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String(), requests
+}
+
+// newTestRawH2CServer accepts HTTP/2 with prior knowledge and sends the
+// regular header fields of each request, in wire order, to the returned
+// channel.
+func newTestRawH2CServer(t testing.TB) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan []string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveRawH2C(conn, requests)
+		}
+	}()
+	return "http://" + ln.Addr().String(), requests
+}
+
+func serveRawH2C(conn net.Conn, requests chan<- []string) {
+	defer conn.Close()
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		return
+	}
+	fr := http2.NewFramer(conn, conn)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := fr.WriteSettings(); err != nil {
+		return
+	}
+	var hbuf bytes.Buffer
+	henc := hpack.NewEncoder(&hbuf)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := fr.WriteSettingsAck(); err != nil {
+					return
+				}
+			}
+		case *http2.MetaHeadersFrame:
+			var fields []string
+			for _, hf := range f.RegularFields() {
+				fields = append(fields, hf.Name+": "+hf.Value)
+			}
+			requests <- fields
+			hbuf.Reset()
+			_ = henc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			err := fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      f.StreamID,
+				BlockFragment: hbuf.Bytes(),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// newTestRawH3Server accepts HTTP/3 and sends the regular header fields of
+// each request, in wire order, to the returned channel.
+func newTestRawH3Server(t testing.TB) (string, <-chan []string) {
+	t.Helper()
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{http3.NextProtoH3},
+	}, nil)
+	if err != nil {
+		t.Fatalf("listen quic: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan []string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go serveRawH3(conn, requests)
+		}
+	}()
+	return "https://" + ln.Addr().String(), requests
+}
+
+func serveRawH3(conn *quic.Conn, requests chan<- []string) {
+	defer conn.CloseWithError(0, "")
+	// The control stream: its type, then an empty SETTINGS frame.
+	ctrl, err := conn.OpenUniStream()
+	if err != nil {
+		return
+	}
+	if _, err := ctrl.Write([]byte{0x00, 0x04, 0x00}); err != nil {
+		return
+	}
+	for {
+		str, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		r := quicvarint.NewReader(str)
+		typ, err := quicvarint.Read(r)
+		if err != nil || typ != 0x01 {
+			return
+		}
+		n, err := quicvarint.Read(r)
+		if err != nil {
+			return
+		}
+		block := make([]byte, n)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return
+		}
+		var fields []string
+		decode := qpack.NewDecoder().Decode(block)
+		for {
+			hf, err := decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(hf.Name, ":") {
+				fields = append(fields, hf.Name+": "+hf.Value)
+			}
+		}
+		requests <- fields
+
+		var hbuf bytes.Buffer
+		_ = qpack.NewEncoder(&hbuf).WriteField(qpack.HeaderField{Name: ":status", Value: "200"})
+		frame := quicvarint.Append(quicvarint.Append(nil, 0x01), uint64(hbuf.Len()))
+		if _, err := str.Write(append(frame, hbuf.Bytes()...)); err != nil {
+			return
+		}
+		_ = str.Close()
+	}
+}
@@ -0,0 +1,126 @@
+package v2fasthttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// clientTransports are the proxies, dialer and transports of a client. The
+// proxy setters replace them as a whole, so they can run while requests are
+// under way: a request keeps the transports it started with.
+type clientTransports struct {
+	// proxies are the proxies set with the proxy setters.
+	proxies []ProxySpec
+	// dial is the TCP dialer, or nil to connect directly.
+	dial dialContextFunc
+	// pac, if set, picks the proxies of each request.
+	pac  *pacScript
+	h2   *h2Transport
+	race *h3Racer
+
+	// httpProxy and httpDial back the Proxy and DialContext of the net/http
+	// transport, and h3Dial the Dial of the HTTP/3 one.
+	httpProxy func(*http.Request) (*url.URL, error)
+	httpDial  dialContextFunc
+	h3Dial    quicDialFunc
+}
+
+var noTransports = &clientTransports{}
+
+func (c *Client) current() *clientTransports {
+	if t := c.transports.Load(); t != nil {
+		return t
+	}
+	return noTransports
+}
+
+// updateTransports replaces the transports with a copy changed by update,
+// then closes the idle connections made through the previous ones.
+func (c *Client) updateTransports(update func(t *clientTransports)) {
+	c.transportsMu.Lock()
+	old := c.current()
+	t := *old
+	update(&t)
+	if !c.fasthttpDial.Load() {
+		// A client built without NewClientWithOptions gets its fasthttp
+		// dialer on its first proxy change.
+		c.Client.Dial = c.dialFasthttp
+		c.fasthttpDial.Store(true)
+	}
+	c.transports.Store(&t)
+	c.transportsMu.Unlock()
+
+	if old.h2 != nil && old.h2 != t.h2 {
+		old.h2.closeIdleConnections()
+	}
+	if old.race != nil && old.race != t.race {
+		old.race.closeIdleConnections()
+	}
+	c.CloseIdleConnections()
+}
+
+// useTransportHooks points the transports at the client's current dialer
+// and proxy. It runs once, before the first request: the transports read
+// these fields while requests are under way.
+func (c *Client) useTransportHooks() {
+	c.Client.Dial = c.dialFasthttp
+	c.fasthttpDial.Store(true)
+	if tr := trFromHTTPClient(c.httpClient); tr != nil {
+		tr.Proxy = c.netHTTPProxy
+		tr.DialContext = c.netHTTPDial
+	}
+	if h3 := c.h3Transport(); h3 != nil {
+		h3.Dial = c.h3Dial
+	}
+}
+
+func (c *Client) netHTTPProxy(req *http.Request) (*url.URL, error) {
+	if proxy := c.current().httpProxy; proxy != nil {
+		return proxy(req)
+	}
+	return nil, nil
+}
+
+// netHTTPDialer is the dialer net/http uses by default.
+var netHTTPDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+func (c *Client) netHTTPDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial := c.current().httpDial; dial != nil {
+		return dial(ctx, network, addr)
+	}
+	return netHTTPDialer.DialContext(ctx, network, addr)
+}
+
+func (c *Client) h3Dial(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	tlsCfg, cfg = sessionsThrough(tlsCfg, nil), tokensThrough(cfg, nil)
+	if dial := c.current().h3Dial; dial != nil {
+		return dial(ctx, addr, tlsCfg, cfg)
+	}
+	return c.dialQUIC(ctx, addr, tlsCfg, cfg)
+}
+
+// refuseRequests makes every request fail with err. It is for a client
+// whose proxy setting was invalid: connecting directly would bypass it.
+func (c *Client) refuseRequests(err error) {
+	err = fmt.Errorf("invalid proxy setting: %w", err)
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		return nil, err
+	}
+	c.updateTransports(func(t *clientTransports) {
+		t.proxies, t.dial, t.pac = nil, dial, nil
+		t.httpProxy, t.httpDial = nil, dial
+		if c.h3Transport() != nil {
+			t.h3Dial = func(context.Context, string, *tls.Config, *quic.Config) (*quic.Conn, error) {
+				return nil, err
+			}
+			c.enableHTTP2Fallback(t)
+		}
+	})
+}